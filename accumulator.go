@@ -0,0 +1,46 @@
+package mapreduce
+
+import "sync"
+
+// Accumulator collects the elements added concurrently, the zero value is ready to use.
+// The reducer is the only consumer of pipe, so a plain slice is enough there. Use Accumulator
+// where the elements are added concurrently, like in the mappers of ForEach,
+// or in the goroutines started by the reducer.
+type Accumulator[T any] struct {
+	lock  sync.Mutex
+	items []T
+}
+
+// Add adds item into the Accumulator.
+func (a *Accumulator[T]) Add(item T) {
+	a.lock.Lock()
+	a.items = append(a.items, item)
+	a.lock.Unlock()
+}
+
+// Result returns a copy of the added elements, in the order of adding.
+func (a *Accumulator[T]) Result() []T {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]T(nil), a.items...)
+}
+
+// Counter sums the numbers added concurrently, the zero value is ready to use.
+type Counter[T Number] struct {
+	lock  sync.Mutex
+	value T
+}
+
+// Add adds delta into the Counter.
+func (c *Counter[T]) Add(delta T) {
+	c.lock.Lock()
+	c.value += delta
+	c.lock.Unlock()
+}
+
+// Value returns the sum of the added numbers.
+func (c *Counter[T]) Value() T {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
@@ -0,0 +1,63 @@
+package mapreduce
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestAccumulator(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 1000
+	t.Run("concurrent", func(t *testing.T) {
+		var acc Accumulator[int]
+		ForEach(FromIter(func(yield func(int) bool) {
+			for i := 0; i < tasks; i++ {
+				if !yield(i) {
+					return
+				}
+			}
+		}), func(item int) {
+			acc.Add(item)
+		})
+
+		items := acc.Result()
+		assert.Len(t, items, tasks)
+		sort.Ints(items)
+		for i, item := range items {
+			assert.Equal(t, i, item)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		var acc Accumulator[int]
+		acc.Add(1)
+		items := acc.Result()
+		items[0] = 2
+		assert.Equal(t, []int{1}, acc.Result())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var acc Accumulator[string]
+		assert.Empty(t, acc.Result())
+	})
+}
+
+func TestCounter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 1000
+	var counter Counter[int64]
+	ForEach(Repeat(int64(2), tasks), func(item int64) {
+		counter.Add(item)
+	})
+	assert.Equal(t, int64(tasks*2), counter.Value())
+
+	var ratio Counter[float64]
+	ratio.Add(0.5)
+	ratio.Add(0.25)
+	assert.Equal(t, 0.75, ratio.Value())
+}
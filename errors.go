@@ -0,0 +1,82 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// PhaseGenerate is the phase of generating elements.
+	PhaseGenerate Phase = iota
+	// PhaseMap is the phase of mapping elements.
+	PhaseMap
+	// PhaseReduce is the phase of reducing elements.
+	PhaseReduce
+)
+
+type (
+	// Phase is the phase of a mapreduce processing.
+	Phase int
+
+	// MapReduceError is the error that a mapreduce processing failed with,
+	// it's returned if cancel is called or a panic is converted by the panic handler.
+	MapReduceError struct {
+		// Name is the name of the processing, customized by WithName.
+		Name string
+		// Phase is the phase that the error occurred.
+		Phase Phase
+		// Cause is the error passed to cancel, or converted from the panic.
+		Cause error
+		// PanicValue is the recovered panic value, nil if not panicked.
+		PanicValue any
+	}
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseGenerate:
+		return "generate"
+	case PhaseMap:
+		return "map"
+	case PhaseReduce:
+		return "reduce"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+func (e *MapReduceError) Error() string {
+	if len(e.Name) == 0 {
+		return e.Cause.Error()
+	}
+
+	return fmt.Sprintf("mapreduce[%s]: %s", e.Name, e.Cause.Error())
+}
+
+// Unwrap returns the cause of the error.
+func (e *MapReduceError) Unwrap() error {
+	return e.Cause
+}
+
+// IsCancelledWithNil returns true if err is or wraps ErrCancelWithNil.
+func IsCancelledWithNil(err error) bool {
+	return errors.Is(err, ErrCancelWithNil)
+}
+
+// IsNoReduceOutput returns true if err is or wraps ErrReduceNoOutput.
+func IsNoReduceOutput(err error) bool {
+	return errors.Is(err, ErrReduceNoOutput)
+}
+
+// newCancelError returns the error that cancel is called with err in phase.
+func newCancelError(name string, phase Phase, err error) error {
+	if err == nil {
+		err = ErrCancelWithNil
+	}
+
+	return &MapReduceError{
+		Name:  name,
+		Phase: phase,
+		Cause: err,
+	}
+}
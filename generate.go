@@ -0,0 +1,414 @@
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"sync"
+	"time"
+)
+
+// sourceQuits keeps the quit channels of the sources built for generate funcs,
+// keyed by both the send-only and receive-only directions of the source,
+// so that the generators can stop early if the processing doesn't need more elements.
+var sourceQuits sync.Map
+
+type sourceQuit struct {
+	channel chan struct{}
+	once    sync.Once
+}
+
+// FromSlice returns a GenerateFunc that sends all the items into source,
+// it stops sending if the processing doesn't need more elements.
+func FromSlice[T any](items []T) GenerateFunc[T] {
+	return func(source chan<- T) {
+		quit := QuitChan(source)
+		for _, item := range items {
+			select {
+			case <-quit:
+				return
+			case source <- item:
+			}
+		}
+	}
+}
+
+// FromSliceChunked returns a GenerateFunc that sends the items into source in chunks of at most chunk items,
+// the last chunk holds the remainder. Non-positive chunk means all the items are in one chunk.
+// The chunks share the underlying array of items, but appending to a chunk never overwrites the others.
+// It stops sending if the processing doesn't need more elements.
+func FromSliceChunked[T any](items []T, chunk int) GenerateFunc[[]T] {
+	return func(source chan<- []T) {
+		if len(items) == 0 {
+			return
+		}
+		if chunk <= 0 {
+			chunk = len(items)
+		}
+
+		quit := QuitChan(source)
+		for i := 0; i < len(items); i += chunk {
+			end := min(i+chunk, len(items))
+			select {
+			case <-quit:
+				return
+			case source <- items[i:end:end]:
+			}
+		}
+	}
+}
+
+// Pair is a key/value pair of a map.
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// FromMap returns a GenerateFunc that sends all the key/value pairs of m into source,
+// the order is unspecified. It stops sending if the processing doesn't need more elements.
+func FromMap[K comparable, V any](m map[K]V) GenerateFunc[Pair[K, V]] {
+	return func(source chan<- Pair[K, V]) {
+		quit := QuitChan(source)
+		for k, v := range m {
+			select {
+			case <-quit:
+				return
+			case source <- Pair[K, V]{
+				Key:   k,
+				Value: v,
+			}:
+			}
+		}
+	}
+}
+
+// FromIter returns a GenerateFunc that sends all the elements of seq into source,
+// it stops iterating if the processing doesn't need more elements.
+func FromIter[T any](seq iter.Seq[T]) GenerateFunc[T] {
+	return func(source chan<- T) {
+		quit := QuitChan(source)
+		for item := range seq {
+			select {
+			case <-quit:
+				return
+			case source <- item:
+			}
+		}
+	}
+}
+
+// FromChannel returns a GenerateFunc that pumps all the elements from ch into source,
+// it stops pumping when ch is closed, or if the processing doesn't need more elements,
+// even if ch is never closed. A nil ch is treated as an empty channel.
+func FromChannel[T any](ch <-chan T) GenerateFunc[T] {
+	return func(source chan<- T) {
+		if ch == nil {
+			return
+		}
+
+		quit := QuitChan(source)
+		for {
+			select {
+			case <-quit:
+				return
+			case item, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				select {
+				case <-quit:
+					return
+				case source <- item:
+				}
+			}
+		}
+	}
+}
+
+// Repeat returns a GenerateFunc that sends value into source count times,
+// it stops sending if the processing doesn't need more elements.
+func Repeat[T any](value T, count int) GenerateFunc[T] {
+	return func(source chan<- T) {
+		quit := QuitChan(source)
+		for i := 0; i < count; i++ {
+			select {
+			case <-quit:
+				return
+			case source <- value:
+			}
+		}
+	}
+}
+
+// RepeatForever returns a GenerateFunc that sends value into source endlessly,
+// until the processing doesn't need more elements, like being cancelled or WithMaxItems reached.
+// It's handy for benchmarks and load generation.
+func RepeatForever[T any](value T) GenerateFunc[T] {
+	return func(source chan<- T) {
+		quit := QuitChan(source)
+		for {
+			select {
+			case <-quit:
+				return
+			case source <- value:
+			}
+		}
+	}
+}
+
+// FromTicker returns a GenerateFunc that sends the current time into source every d until ctx is done,
+// which drives the periodic processing, like the scheduled aggregations. The ticker is stopped on exit.
+// It stops sending if the processing doesn't need more elements. Non-positive d sends nothing.
+func FromTicker(ctx context.Context, d time.Duration) GenerateFunc[time.Time] {
+	return func(source chan<- time.Time) {
+		if d <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+
+		quit := QuitChan(source)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-quit:
+				return
+			case now := <-ticker.C:
+				select {
+				case <-ctx.Done():
+					return
+				case <-quit:
+					return
+				case source <- now:
+				}
+			}
+		}
+	}
+}
+
+// RetryGenerate returns a GenerateFuncErr that calls generate at most attempts times until it succeeds,
+// such as re-establishing a dropped stream. The elements sent before failing stay sent,
+// so generate should resume from where it failed. The last error is returned if all attempts fail,
+// use it with MapReduceGen to cancel the processing. It stops retrying if the processing
+// doesn't need more elements.
+func RetryGenerate[T any](attempts int, generate GenerateFuncErr[T]) GenerateFuncErr[T] {
+	return func(source chan<- T) error {
+		quit := QuitChan(source)
+		err := generate(source)
+		for attempt := 1; err != nil && attempt < attempts; attempt++ {
+			select {
+			case <-quit:
+				return err
+			default:
+			}
+
+			err = generate(source)
+		}
+
+		return err
+	}
+}
+
+// FromJSONLines returns a GenerateFuncErr that decodes each line of r as a JSON value into source,
+// the blank lines are ignored. It returns an error with the line number on a malformed line or a read error,
+// use it with MapReduceGen to cancel the processing. It stops reading if the processing doesn't need more elements.
+func FromJSONLines[T any](r io.Reader) GenerateFuncErr[T] {
+	return fromJSONLines[T](r, false, nil)
+}
+
+// FromJSONLinesSkip is like FromJSONLines, but skips the malformed lines,
+// and calls onSkip with the line number and the decoding error if onSkip is not nil.
+func FromJSONLinesSkip[T any](r io.Reader, onSkip func(line int, err error)) GenerateFuncErr[T] {
+	return fromJSONLines[T](r, true, onSkip)
+}
+
+func fromJSONLines[T any](r io.Reader, skip bool, onSkip func(line int, err error)) GenerateFuncErr[T] {
+	return func(source chan<- T) error {
+		quit := QuitChan(source)
+		reader := bufio.NewReader(r)
+		for lineNo := 1; ; lineNo++ {
+			// the last line might not end with a newline
+			line, err := reader.ReadBytes('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				var item T
+				if e := json.Unmarshal(line, &item); e != nil {
+					if !skip {
+						return fmt.Errorf("line %d: %w", lineNo, e)
+					}
+					if onSkip != nil {
+						onSkip(lineNo, e)
+					}
+				} else {
+					select {
+					case <-quit:
+						return nil
+					case source <- item:
+					}
+				}
+			}
+
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// Merge fans in all the elements from chans into the returned channel,
+// which is closed after all chans are closed.
+func Merge[T any](chans ...<-chan T) <-chan T {
+	return MergeCtx(context.Background(), chans...)
+}
+
+// MergeCtx fans in all the elements from chans into the returned channel,
+// which is closed after all chans are closed or ctx is done.
+// Use ctx to stop merging if the returned channel is not drained.
+func MergeCtx[T any](ctx context.Context, chans ...<-chan T) <-chan T {
+	output := make(chan T)
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch <-chan T) {
+			defer wg.Done()
+			for {
+				// an idle ch doesn't keep the returned channel open after ctx is done
+				select {
+				case <-ctx.Done():
+					return
+				case item, ok := <-ch:
+					if !ok {
+						return
+					}
+
+					select {
+					case <-ctx.Done():
+						return
+					case output <- item:
+					}
+				}
+			}
+		}(ch)
+	}
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+
+	return output
+}
+
+// Partition splits the elements from source into n channels by the hash of the key returned from keyFn,
+// the elements with the same key are always written into the same channel.
+// All the returned channels are closed after source is closed, they must be drained concurrently.
+// Non-positive n means 1.
+func Partition[T any, K comparable](source <-chan T, n int, keyFn func(item T) K) []<-chan T {
+	if n < 1 {
+		n = 1
+	}
+
+	chans := make([]chan T, n)
+	partitions := make([]<-chan T, n)
+	for i := range chans {
+		chans[i] = make(chan T)
+		partitions[i] = chans[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, ch := range chans {
+				close(ch)
+			}
+		}()
+
+		for item := range source {
+			h := fnv.New32a()
+			_, _ = fmt.Fprint(h, keyFn(item))
+			chans[h.Sum32()%uint32(n)] <- item
+		}
+	}()
+
+	return partitions
+}
+
+// Tee duplicates all the elements from in into n channels, it blocks on the slowest consumer.
+// All the returned channels are closed after in is closed, they must be drained concurrently.
+// Non-positive n means 1.
+func Tee[T any](in <-chan T, n int) []<-chan T {
+	if n < 1 {
+		n = 1
+	}
+
+	chans := make([]chan T, n)
+	outputs := make([]<-chan T, n)
+	for i := range chans {
+		chans[i] = make(chan T)
+		outputs[i] = chans[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, ch := range chans {
+				close(ch)
+			}
+		}()
+
+		for item := range in {
+			for _, ch := range chans {
+				ch <- item
+			}
+		}
+	}()
+
+	return outputs
+}
+
+// registerSource registers a quit channel for source, the returned func unregisters it.
+func registerSource[T any](source chan T) func() {
+	quit := &sourceQuit{
+		channel: make(chan struct{}),
+	}
+	sendKey, recvKey := (chan<- T)(source), (<-chan T)(source)
+	sourceQuits.Store(sendKey, quit)
+	sourceQuits.Store(recvKey, quit)
+
+	return func() {
+		sourceQuits.Delete(sendKey)
+		sourceQuits.Delete(recvKey)
+	}
+}
+
+// quitSource closes the quit channel of source if registered.
+func quitSource[T any](source <-chan T) {
+	if v, ok := sourceQuits.Load(source); ok {
+		quit := v.(*sourceQuit)
+		quit.once.Do(func() {
+			close(quit.channel)
+		})
+	}
+}
+
+// QuitChan returns a channel that is closed if the processing doesn't need more elements from source,
+// like being cancelled. The generate funcs should stop sending after it's closed, the source is only
+// drained until the processing is done, so the ones still sending are left blocked, never returning.
+// A nil channel is returned if source is not passed to a generate func by this package.
+func QuitChan[T any](source chan<- T) <-chan struct{} {
+	if v, ok := sourceQuits.Load(source); ok {
+		return v.(*sourceQuit).channel
+	}
+
+	return nil
+}
@@ -0,0 +1,619 @@
+package mapreduce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestFromSlice(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("non empty", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, val)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		val, err := MapReduce(FromSlice[int](nil), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, val)
+	})
+}
+
+func TestFromMap(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("non empty", func(t *testing.T) {
+		m := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			m[fmt.Sprint(i)] = i
+		}
+
+		val, err := MapReduce(FromMap(m), func(item Pair[string, int], writer Writer[Pair[string, int]],
+			cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan Pair[string, int], writer Writer[map[string]int], cancel func(error)) {
+			result := make(map[string]int)
+			for item := range pipe {
+				_, ok := result[item.Key]
+				assert.False(t, ok, "key %s processed more than once", item.Key)
+				result[item.Key] = item.Value
+			}
+			writer.Write(result)
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, m, val)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		val, err := MapReduce(FromMap[string, int](nil), func(item Pair[string, int], writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item.Value)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, val)
+	})
+}
+
+func TestFromSliceChunked(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name   string
+		items  []int
+		chunk  int
+		expect [][]int
+	}{
+		{
+			name:   "even",
+			items:  []int{1, 2, 3, 4},
+			chunk:  2,
+			expect: [][]int{{1, 2}, {3, 4}},
+		},
+		{
+			name:   "remainder",
+			items:  []int{1, 2, 3, 4, 5},
+			chunk:  2,
+			expect: [][]int{{1, 2}, {3, 4}, {5}},
+		},
+		{
+			name:   "larger chunk",
+			items:  []int{1, 2, 3},
+			chunk:  10,
+			expect: [][]int{{1, 2, 3}},
+		},
+		{
+			name:   "non-positive chunk",
+			items:  []int{1, 2, 3},
+			chunk:  0,
+			expect: [][]int{{1, 2, 3}},
+		},
+		{
+			name:  "empty",
+			items: nil,
+			chunk: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := make(chan []int, len(test.items)+1)
+			FromSliceChunked(test.items, test.chunk)(source)
+			close(source)
+
+			var chunks [][]int
+			for chunk := range source {
+				chunks = append(chunks, chunk)
+			}
+			assert.Equal(t, test.expect, chunks)
+		})
+	}
+
+	t.Run("MapReduce", func(t *testing.T) {
+		val, err := MapReduce(FromSliceChunked([]int{1, 2, 3, 4, 5}, 2), func(items []int, writer Writer[int],
+			cancel func(error)) {
+			var sum int
+			for _, item := range items {
+				sum += item
+			}
+			writer.Write(sum)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 15, val)
+	})
+}
+
+func TestQuitChan(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	assert.Nil(t, QuitChan(make(chan int)))
+
+	// the endless generator stops after quit is closed, otherwise goleak fails
+	var mapped int32
+	ForEach(func(source chan<- int) {
+		quit := QuitChan(source)
+		assert.NotNil(t, quit)
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			case source <- i:
+			}
+		}
+	}, func(item int) {
+		atomic.AddInt32(&mapped, 1)
+	}, WithMaxItems(10), WithWorkers(1))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&mapped))
+}
+
+func TestFromIter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	squares := func(n int) iter.Seq[int] {
+		return func(yield func(int) bool) {
+			for i := 1; n < 0 || i <= n; i++ {
+				if !yield(i * i) {
+					return
+				}
+			}
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		val, err := MapReduce(FromIter(squares(4)), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+
+	t.Run("endless with cancel", func(t *testing.T) {
+		_, err := MapReduce(FromIter(squares(-1)), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 100 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+	})
+
+	t.Run("endless with max items", func(t *testing.T) {
+		val, err := MapReduce(FromIter(squares(-1)), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithMaxItems(4), WithSequential())
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+}
+
+func TestFromChannel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("non empty", func(t *testing.T) {
+		ch := make(chan int, 4)
+		for i := 1; i <= 4; i++ {
+			ch <- i
+		}
+		close(ch)
+
+		val, err := MapReduce(FromChannel(ch), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		val, err := MapReduce(FromChannel[int](nil), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, val)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			for i := 0; i < 100; i++ {
+				ch <- i
+			}
+		}()
+
+		_, err := MapReduce(FromChannel(ch), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 10 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+		// FromChannel stops pumping after cancelled, the producer is stopped by draining ch
+		for range ch {
+		}
+	})
+
+	t.Run("cancel with channel never closed", func(t *testing.T) {
+		ch := make(chan int, 20)
+		for i := 0; i < 20; i++ {
+			ch <- i
+		}
+
+		_, err := MapReduce(FromChannel(ch), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 10 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestRepeat(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name  string
+		count int
+		want  int
+	}{
+		{
+			name:  "count",
+			count: 100,
+			want:  100,
+		},
+		{
+			name:  "zero",
+			count: 0,
+			want:  0,
+		},
+		{
+			name:  "negative",
+			count: -1,
+			want:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mapped int32
+			val, err := MapReduce(Repeat(2, test.count), func(item int, writer Writer[int], cancel func(error)) {
+				atomic.AddInt32(&mapped, 1)
+				writer.Write(item)
+			}, sumReducer)
+			assert.Nil(t, err)
+			assert.Equal(t, test.want*2, val)
+			assert.Equal(t, int32(test.want), atomic.LoadInt32(&mapped))
+		})
+	}
+}
+
+func TestRepeatForever(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("max items", func(t *testing.T) {
+		val, err := MapReduce(RepeatForever(1), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithMaxItems(100))
+		assert.Nil(t, err)
+		assert.Equal(t, 100, val)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		var mapped int32
+		_, err := MapReduce(RepeatForever(1), func(item int, writer Writer[int], cancel func(error)) {
+			if atomic.AddInt32(&mapped, 1) == 100 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestFromTicker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 105*time.Millisecond)
+		defer cancel()
+		val, err := MapReduce(FromTicker(ctx, 10*time.Millisecond),
+			func(item time.Time, writer Writer[int], cancel func(error)) {
+				writer.Write(1)
+			}, sumReducer)
+		assert.Nil(t, err)
+		// the ticks are dropped if the processing is slow, so there might be fewer
+		assert.GreaterOrEqual(t, val, 3)
+		assert.LessOrEqual(t, val, 10)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		var mapped int32
+		_, err := MapReduce(FromTicker(context.Background(), time.Millisecond),
+			func(item time.Time, writer Writer[int], cancel func(error)) {
+				if atomic.AddInt32(&mapped, 1) == 3 {
+					cancel(errDummy)
+				}
+				writer.Write(1)
+			}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+	})
+
+	t.Run("non-positive interval", func(t *testing.T) {
+		assert.Empty(t, Collect(Map(FromTicker(context.Background(), 0),
+			func(item time.Time, writer Writer[time.Time]) {
+				writer.Write(item)
+			})))
+	})
+}
+
+func TestRetryGenerate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// flaky sends the rest items from the last sent one, and fails for the first failures calls
+	flaky := func(items []int, failures int) (GenerateFuncErr[int], *int32) {
+		var next, calls int32
+		return func(source chan<- int) error {
+			if atomic.AddInt32(&calls, 1) <= int32(failures) {
+				// send one more item before dropping
+				source <- items[next]
+				next++
+				return errDummy
+			}
+
+			for ; int(next) < len(items); next++ {
+				source <- items[next]
+			}
+			return nil
+		}, &calls
+	}
+
+	t.Run("fail once", func(t *testing.T) {
+		generate, calls := flaky([]int{1, 2, 3, 4}, 1)
+		val, err := MapReduceGen(RetryGenerate(3, generate), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 10, val)
+		assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	})
+
+	t.Run("all attempts fail", func(t *testing.T) {
+		generate, calls := flaky([]int{1, 2, 3, 4}, 3)
+		_, err := MapReduceGen(RetryGenerate(2, generate), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+		assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	})
+}
+
+func TestFromJSONLines(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	type record struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		input := `{"name":"a","count":1}
+
+{"name":"b","count":2}
+{"name":"c","count":3}`
+		var output strings.Builder
+		val, err := MapReduceGen(FromJSONLines[record](strings.NewReader(input)), func(item record,
+			writer Writer[record], cancel func(error)) {
+			item.Count *= 10
+			writer.Write(item)
+		}, func(pipe <-chan record, writer Writer[int], cancel func(error)) {
+			if err := WriteJSONLines(&output, pipe); err != nil {
+				cancel(err)
+				return
+			}
+			writer.Write(0)
+		}, WithSequential())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, val)
+		assert.Equal(t, `{"name":"a","count":10}
+{"name":"b","count":20}
+{"name":"c","count":30}
+`, output.String())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		input := "{\"name\":\"a\",\"count\":1}\n{\"name\":\n{\"name\":\"c\",\"count\":3}\n"
+		_, err := MapReduceGen(FromJSONLines[record](strings.NewReader(input)), func(item record,
+			writer Writer[int], cancel func(error)) {
+			writer.Write(item.Count)
+		}, sumReducer)
+		var syntaxErr *json.SyntaxError
+		assert.True(t, errors.As(err, &syntaxErr))
+		assert.Contains(t, err.Error(), "line 2")
+	})
+
+	t.Run("skip malformed", func(t *testing.T) {
+		input := "{\"name\":\"a\",\"count\":1}\n{\"name\":\n{\"name\":\"c\",\"count\":3}\n"
+		var skipped []int
+		val, err := MapReduceGen(FromJSONLinesSkip[record](strings.NewReader(input), func(line int, err error) {
+			assert.Error(t, err)
+			skipped = append(skipped, line)
+		}), func(item record, writer Writer[int], cancel func(error)) {
+			writer.Write(item.Count)
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, val)
+		assert.Equal(t, []int{2}, skipped)
+	})
+}
+
+func TestMerge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	chans := make([]<-chan int, 3)
+	for i := range chans {
+		ch := make(chan int, 10)
+		for j := 0; j < 10; j++ {
+			ch <- j
+		}
+		close(ch)
+		chans[i] = ch
+	}
+
+	val, err := MapReduceChan(Merge(chans...), func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}, func(pipe <-chan int, writer Writer[[2]int], cancel func(error)) {
+		var count, sum int
+		for item := range pipe {
+			count++
+			sum += item
+		}
+		writer.Write([2]int{count, sum})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [2]int{30, 3 * 45}, val)
+}
+
+func TestMergeEmpty(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	_, ok := <-Merge[int]()
+	assert.False(t, ok)
+}
+
+func TestMergeCtx(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		ch <- i
+	}
+	close(ch)
+
+	output := MergeCtx(ctx, ch, ch)
+	<-output
+	// stop reading, the merging goroutines should quit
+	cancel()
+	for range output {
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		// idle is never written or closed
+		idle := make(chan int)
+		output := MergeCtx(ctx, idle)
+		cancel()
+
+		select {
+		case _, ok := <-output:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("output not closed after ctx done")
+		}
+	})
+}
+
+func TestPartition(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	source := make(chan int)
+	go func() {
+		defer close(source)
+		for i := 0; i < 1000; i++ {
+			source <- i
+		}
+	}()
+
+	partitions := Partition(source, 4, func(item int) int {
+		return item % 10
+	})
+	assert.Len(t, partitions, 4)
+
+	var wg sync.WaitGroup
+	counts := make([]int, len(partitions))
+	keys := make([]map[int]bool, len(partitions))
+	for i, partition := range partitions {
+		wg.Add(1)
+		go func(i int, partition <-chan int) {
+			defer wg.Done()
+			keys[i] = make(map[int]bool)
+			for item := range partition {
+				counts[i]++
+				keys[i][item%10] = true
+			}
+		}(i, partition)
+	}
+	wg.Wait()
+
+	var total int
+	owners := make(map[int]int)
+	for i := range partitions {
+		total += counts[i]
+		for key := range keys[i] {
+			_, ok := owners[key]
+			assert.False(t, ok, "key %d in more than one partition", key)
+			owners[key] = i
+		}
+	}
+	assert.Equal(t, 1000, total)
+	assert.Len(t, owners, 10)
+}
+
+func TestTee(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for i := 0; i < 100; i++ {
+			in <- i
+		}
+	}()
+
+	outputs := Tee(in, 2)
+	assert.Len(t, outputs, 2)
+
+	var wg sync.WaitGroup
+	results := make([][]int, len(outputs))
+	for i, output := range outputs {
+		wg.Add(1)
+		go func(i int, output <-chan int) {
+			defer wg.Done()
+			results[i] = Collect(output)
+		}(i, output)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		assert.Len(t, result, 100)
+		for i, item := range result {
+			assert.Equal(t, i, item)
+		}
+	}
+}
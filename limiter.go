@@ -0,0 +1,325 @@
+package mapreduce
+
+import (
+	"context"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiter with burst 1, it's not goroutine-safe.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing perSecond events per second,
+// nil is returned if perSecond is not positive, which means no limit.
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+	}
+}
+
+// wait blocks until an event is allowed, returns false if ctx or done is closed.
+func (l *rateLimiter) wait(ctx context.Context, done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+	if l.next.After(now) {
+		timer := time.NewTimer(l.next.Sub(now))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-done:
+			return false
+		case <-timer.C:
+		}
+		now = l.next
+	}
+
+	l.next = now.Add(l.interval)
+	return true
+}
+
+// warmupGate ramps up the limit of the running mappers exponentially from 1 to workers,
+// the limit doubles in each step, and reaches workers after the warmup duration.
+type warmupGate struct {
+	start    time.Time
+	interval time.Duration
+	steps    int
+	workers  int
+	// finished is signaled if a mapper finished, so that the waiting one can be admitted
+	finished chan struct{}
+}
+
+// newWarmupGate returns a warmupGate ramping up to workers in duration, nil is returned if duration
+// is too short to have a step, or workers is not more than 1, which means no warmup.
+func newWarmupGate(workers int, duration time.Duration) *warmupGate {
+	if workers <= 1 {
+		return nil
+	}
+
+	// the limit reaches workers after steps doublings
+	steps := bits.Len(uint(workers - 1))
+	interval := duration / time.Duration(steps)
+	if interval <= 0 {
+		return nil
+	}
+
+	return &warmupGate{
+		start:    time.Now(),
+		interval: interval,
+		steps:    steps,
+		workers:  workers,
+		finished: make(chan struct{}, 1),
+	}
+}
+
+// limit returns the current limit, and the duration to wait for the next step, 0 if warmed up.
+func (g *warmupGate) limit() (int, time.Duration) {
+	elapsed := time.Since(g.start)
+	step := int(elapsed / g.interval)
+	if step >= g.steps {
+		return g.workers, 0
+	}
+
+	return min(1<<step, g.workers), g.interval*time.Duration(step+1) - elapsed
+}
+
+// wait blocks until running is under the current limit, returns false if ctx or done is closed.
+// It's only called by the scheduling loop, the only one increasing running.
+func (g *warmupGate) wait(ctx context.Context, done <-chan struct{}, running func() int) bool {
+	if g == nil {
+		return true
+	}
+
+	for {
+		limit, next := g.limit()
+		if next <= 0 || running() < limit {
+			return true
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-done:
+			timer.Stop()
+			return false
+		case <-g.finished:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// release signals the waiting scheduler that a mapper finished.
+func (g *warmupGate) release() {
+	if g == nil {
+		return
+	}
+
+	select {
+	case g.finished <- struct{}{}:
+	default:
+	}
+}
+
+// scaledPool limits the running mappers to a limit which can be changed on the fly.
+type scaledPool struct {
+	// admit is received by the scaling goroutine if the running mappers are under the limit
+	admit    chan struct{}
+	released chan struct{}
+	quit     chan struct{}
+}
+
+// newScaledPool returns a scaledPool starting with workers as the limit,
+// the positive values received from ctrl become the new limit, clamped to maxWorkers if positive.
+// The running mappers beyond a decreased limit are not interrupted.
+func newScaledPool(workers, maxWorkers int, ctrl <-chan int) *scaledPool {
+	p := &scaledPool{
+		admit:    make(chan struct{}),
+		released: make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+
+	go func() {
+		var running int
+		limit := workers
+		for {
+			var admit chan struct{}
+			if running < limit {
+				admit = p.admit
+			}
+
+			select {
+			case <-p.quit:
+				return
+			case <-admit:
+				running++
+			case <-p.released:
+				running--
+			case n, ok := <-ctrl:
+				if !ok {
+					// keep the current limit after ctrl is closed
+					ctrl = nil
+				} else if n > 0 {
+					limit = n
+					if maxWorkers > 0 {
+						limit = min(limit, maxWorkers)
+					}
+				}
+			}
+		}
+	}()
+
+	return p
+}
+
+// release lets another mapper run, it must be called before stop.
+func (p *scaledPool) release() {
+	p.released <- struct{}{}
+}
+
+// stop stops the scaling goroutine.
+func (p *scaledPool) stop() {
+	close(p.quit)
+}
+
+type (
+	globalLimitKey struct{}
+	// lentTokenKey marks the ctx of the mappers holding a global token,
+	// the nested processings started with it run on the token of the calling mapper.
+	lentTokenKey struct{}
+)
+
+// WithGlobalLimit returns a copy of ctx carrying a budget of n concurrent mappers,
+// which is shared by the processings customized by WithContext with it, including the nested ones.
+// The nested processings started with the ctx of the mappers in MapReduceCtx inherit the budget,
+// and run one mapper on the token of the calling mapper, so that they never deadlock on the budget.
+// A mapper gives up its token while writing, so the mappers blocked on a slow reducer don't starve
+// the nested processings started by the reducer.
+func WithGlobalLimit(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, globalLimitKey{}, make(chan struct{}, max(n, 1)))
+}
+
+// globalGate acquires the tokens of the budget customized by WithGlobalLimit for a processing.
+type globalGate struct {
+	tokens chan struct{}
+	// lent holds the token of the calling mapper if nested, nil otherwise
+	lent chan struct{}
+}
+
+// newGlobalGate returns the globalGate of the budget in ctx, nil is returned if no budget, which means no limit.
+func newGlobalGate(ctx context.Context) *globalGate {
+	tokens, ok := ctx.Value(globalLimitKey{}).(chan struct{})
+	if !ok {
+		return nil
+	}
+
+	gate := &globalGate{tokens: tokens}
+	if ctx.Value(lentTokenKey{}) != nil {
+		gate.lent = make(chan struct{}, 1)
+		gate.lent <- struct{}{}
+	}
+	return gate
+}
+
+// acquire blocks until a token is acquired, returns false if ctx or done is closed.
+// nil is returned with true if g is nil, which means no limit.
+func (g *globalGate) acquire(ctx context.Context, done <-chan struct{}) (*globalToken, bool) {
+	if g == nil {
+		return nil, true
+	}
+
+	token := &globalToken{gate: g}
+	if !token.take(ctx, done) {
+		return nil, false
+	}
+
+	return token, true
+}
+
+// globalToken is the token of the budget held by a mapper, it's given up while the mapper is writing.
+type globalToken struct {
+	gate *globalGate
+	// lock serializes the writes from the goroutines started by the mapper
+	lock sync.Mutex
+	lent bool
+	held bool
+}
+
+// release releases the token if held.
+func (t *globalToken) release() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.put()
+}
+
+// take blocks until the token is held, returns false if ctx or done is closed.
+func (t *globalToken) take(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-done:
+		return false
+	case <-t.gate.lent:
+		t.lent = true
+	case t.gate.tokens <- struct{}{}:
+		t.lent = false
+	}
+
+	t.held = true
+	return true
+}
+
+// put gives up the token if held.
+func (t *globalToken) put() {
+	if !t.held {
+		return
+	}
+
+	if t.lent {
+		t.gate.lent <- struct{}{}
+	} else {
+		<-t.gate.tokens
+	}
+	t.held = false
+}
+
+// tokenWriter releases the token of the mapper while writing, and acquires it again after written.
+type tokenWriter[T any] struct {
+	writer CheckedWriter[T]
+	token  *globalToken
+	ctx    context.Context
+	done   <-chan struct{}
+}
+
+func (tw tokenWriter[T]) Write(v T) {
+	tw.WriteOK(v)
+}
+
+func (tw tokenWriter[T]) WriteOK(v T) bool {
+	tw.token.lock.Lock()
+	defer tw.token.lock.Unlock()
+
+	tw.token.put()
+	ok := tw.writer.WriteOK(v)
+	// the mapper goes on without a token if cancelled, which stops soon
+	tw.token.take(tw.ctx, tw.done)
+	return ok
+}
@@ -3,13 +3,43 @@ package mapreduce
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	defaultWorkers = 16
-	minWorkers     = 1
+	defaultWorkers    = 16
+	defaultMaxWorkers = 1 << 16
+	minWorkers        = 1
+)
+
+const (
+	// DrainPolicyAbort drops the outputs of the in-flight mappers if cancelled, which is the default.
+	DrainPolicyAbort DrainPolicy = iota
+	// DrainPolicyGraceful stops scheduling new mappers if cancelled,
+	// but waits for the in-flight mappers and keeps their outputs.
+	DrainPolicyGraceful
+)
+
+const (
+	// WorkerPanicAbort stops the processing if a mapper panics, which is the default.
+	WorkerPanicAbort WorkerPanicPolicy = iota
+	// WorkerPanicSkip skips the element that the mapper panics on, and continues processing.
+	WorkerPanicSkip
+)
+
+const (
+	// ReducerMultiWritePanic panics if reducer writes more than once, which is the default.
+	ReducerMultiWritePanic ReducerMultiWriteMode = iota
+	// ReducerMultiWriteError returns ErrReducerMultiWrite if reducer writes more than once.
+	ReducerMultiWriteError
+	// ReducerMultiWriteFirst keeps the first value if reducer writes more than once.
+	ReducerMultiWriteFirst
+	// ReducerMultiWriteLast keeps the last value if reducer writes more than once.
+	ReducerMultiWriteLast
 )
 
 var (
@@ -17,13 +47,36 @@ var (
 	ErrCancelWithNil = errors.New("mapreduce cancelled with nil")
 	// ErrReduceNoOutput is an error that reduce did not output a value.
 	ErrReduceNoOutput = errors.New("reduce not writing value")
+	// ErrStop is used to stop the processing early without error, pass it to cancel.
+	// No more mappers are scheduled, the in-flight ones keep running,
+	// and the value written by reducer is returned.
+	ErrStop = errors.New("mapreduce stopped")
+	// ErrShutdownTimeout is an error that the mappers and reducer didn't finish in the shutdown timeout.
+	ErrShutdownTimeout = errors.New("mapreduce shutdown timeout")
+	// ErrReducerMultiWrite is an error that reducer wrote more than one value.
+	ErrReducerMultiWrite = errors.New("more than one element written in reducer")
+	// ErrNilFunc is an error that a nil generate, mapper or reducer was passed.
+	// The functions without returning an error panic with it instead.
+	ErrNilFunc = errors.New("mapreduce with nil func")
+	// ErrMapperTimeout is an error that a mapper didn't finish in the timeout customized by WithMapperTimeout.
+	ErrMapperTimeout = errors.New("mapreduce mapper timeout")
+	// ErrWriteAfterClose is an error that a value was written after all the mappers returned,
+	// which is reported if WithCollectorClosedCheck is used.
+	ErrWriteAfterClose = errors.New("mapreduce write after collector closed")
+
+	// errSucceeded is used to cancel the rest fns of AnyCtx after the first success.
+	errSucceeded = errors.New("mapreduce succeeded")
 )
 
 type (
 	// ForEachFunc is used to do element processing, but no output.
 	ForEachFunc[T any] func(item T)
 	// GenerateFunc is used to let callers send elements into source.
+	// The endless generate funcs must stop after QuitChan(source) is closed.
 	GenerateFunc[T any] func(source chan<- T)
+	// GenerateFuncErr is used to let callers send elements into source,
+	// the returned error cancels the processing, such as failing to fetch the next page.
+	GenerateFuncErr[T any] func(source chan<- T) error
 	// MapFunc is used to do element processing and write the output to writer.
 	MapFunc[T, U any] func(item T, writer Writer[U])
 	// MapperFunc is used to do element processing and write the output to writer,
@@ -32,11 +85,87 @@ type (
 	// ReducerFunc is used to reduce all the mapping output and write to writer,
 	// use cancel func to cancel the processing.
 	ReducerFunc[U, V any] func(pipe <-chan U, writer Writer[V], cancel func(error))
+	// BatchMapperFunc is used to do processing on a batch of elements and write the output to writer,
+	// use cancel func to cancel the processing.
+	BatchMapperFunc[T, U any] func(items []T, writer Writer[U], cancel func(error))
+	// MapperErrFunc is used to do element processing and write the output to writer,
+	// the returned error cancels the processing if it still fails after retries.
+	MapperErrFunc[T, U any] func(item T, writer Writer[U]) error
+	// MapperCtxFunc is used to do element processing with ctx and write the output to writer,
+	// use cancel func to cancel the processing.
+	MapperCtxFunc[T, U any] func(ctx context.Context, item T, writer Writer[U], cancel func(error))
+	// ReducerCtxFunc is used to reduce all the mapping output with ctx and write to writer,
+	// use cancel func to cancel the processing.
+	ReducerCtxFunc[U, V any] func(ctx context.Context, pipe <-chan U, writer Writer[V], cancel func(error))
 	// VoidReducerFunc is used to reduce all the mapping output, but no output.
 	// Use cancel func to cancel the processing.
 	VoidReducerFunc[U any] func(pipe <-chan U, cancel func(error))
+	// ProgressReducerFunc is used to reduce all the mapping output and write to writer,
+	// use cancel func to cancel the processing, and progress to query the number of the elements
+	// written by mappers and the ones received from pipe so far.
+	ProgressReducerFunc[U, V any] func(pipe <-chan U, writer Writer[V], cancel func(error),
+		progress func() (produced, consumed int))
 	// Option defines the method to customize the mapreduce.
 	Option func(opts *mapReduceOptions)
+	// PanicHandlerFunc is used to convert the recovered panic value into an error.
+	PanicHandlerFunc func(recovered any) error
+	// DrainPolicy is the way to handle the in-flight mappers if cancelled.
+	DrainPolicy int
+	// WorkerPanicPolicy is the way to handle the panics in mappers.
+	WorkerPanicPolicy int
+	// ReducerMultiWriteMode is the way to handle the values written by reducer more than once.
+	ReducerMultiWriteMode int
+
+	// Stat is the statistics of the mappers in a mapreduce processing.
+	Stat struct {
+		// InFlight is the number of the running mappers.
+		InFlight int
+		// Completed is the number of the finished mappers.
+		Completed int
+		// QueueDepth is the number of the mapper outputs waiting to be consumed.
+		QueueDepth int
+		// Name is the name of the processing, customized by WithName.
+		Name string
+	}
+
+	// Stats is the statistics of a finished mapreduce processing.
+	Stats struct {
+		// ItemsIn is the number of the elements passed to mapper.
+		ItemsIn int
+		// MapOut is the number of the elements written by mapper.
+		MapOut int
+		// Duration is the elapsed time of the processing.
+		Duration time.Duration
+		// Cancelled is true if the processing is cancelled.
+		Cancelled bool
+	}
+
+	// Options is the effective configuration resolved from the options, returned by ResolveOptions.
+	Options struct {
+		// Name is the name of the processing, customized by WithName.
+		Name string
+		// Workers is the number of workers, after applying WithSequential, WithWorkersFunc and the clamping.
+		Workers int
+		// MaxWorkers is the upper bound of workers, customized by WithMaxWorkers.
+		MaxWorkers int
+		// BufferSize is the buffer size of the channel between mappers and reducer.
+		BufferSize int
+		// SourceBuffer is the buffer size of the source channel.
+		SourceBuffer int
+		// Timeout is the timeout of the processing, 0 means no timeout.
+		Timeout time.Duration
+		// Cancellable is true if the processing can be cancelled by ctx, customized by WithContext or WithTimeout.
+		Cancellable bool
+		// Sequential is true if the mappers are called sequentially.
+		Sequential bool
+	}
+
+	// runStats is the counters of a running processing, a nil runStats counts nothing.
+	runStats struct {
+		itemsIn   int64
+		mapOut    int64
+		cancelled int32
+	}
 
 	mapperContext[T, U any] struct {
 		ctx       context.Context
@@ -45,36 +174,226 @@ type (
 		panicChan *onceChan
 		collector chan<- U
 		doneChan  <-chan struct{}
+		// stopChan is closed to stop scheduling new mappers, but the in-flight ones keep running
+		stopChan  <-chan struct{}
 		workers   int
+		rateLimit int
+		metrics   func(stat Stat)
+		// sequential is true to call mapper synchronously in the order of source
+		sequential bool
+		pool       *Pool
+		// maxItems is the max number of elements to map, non-positive means no limit
+		maxItems int
+		// onStop is called with the counter of in-flight mappers after scheduling stopped
+		onStop func(inFlight func() int)
+		stats  *runStats
+		// skipPanic is called with the recovered value if the panicking mappers are skipped
+		skipPanic func(r any)
+		// semaphore is the max number of the mappers running at the same time, non-positive means no limit
+		semaphore int
+		// scaler receives the new limits of workers, which are clamped to maxWorkers
+		scaler     <-chan int
+		maxWorkers int
+		// weight returns the capacity of workers taken by item, nil means 1 for all elements
+		weight func(item any) int
+		// latency is called with the duration of each mapper call, nil means not recording
+		latency func(d time.Duration)
+		// warmup is the duration to ramp up the running mappers from 1 to workers, non-positive means no warmup
+		warmup time.Duration
+		// pressure reports the writes into collector blocked by the slow reducer
+		pressure backpressure
+		// progress receives the number of the finished mappers without blocking, nil means not reporting
+		progress chan<- int
+		// guard detects the writes after collector is closed, nil means not checking
+		guard *closeGuard
+		// onSchedule is called right before each element is handed to a worker, nil means no hook
+		onSchedule func()
+		// workerInit and workerExit are called once per worker, nil means no hook
+		workerInit func() any
+		workerExit func(value any)
+		// withWorker is called instead of mapper with the value of the worker if workerInit is set
+		withWorker func(value any, item T, w Writer[U])
+		// cleaned is closed after the workers are cleaned up, nil means not notifying
+		cleaned chan struct{}
 	}
 
 	mapReduceOptions struct {
-		ctx     context.Context
-		workers int
+		ctx          context.Context
+		cancel       context.CancelFunc
+		name         string
+		timeout      time.Duration
+		workers      int
+		workersFunc  func() int
+		bufferSize   int
+		allErrors    bool
+		panicHandler PanicHandlerFunc
+		logger       *slog.Logger
+		onError      func(err error)
+		errorFilter  func(err error) bool
+		metrics      func(stat Stat)
+		rateLimit    int
+		retries      int
+		backoff      func(attempt int) time.Duration
+		sequential   bool
+		batchSize    int
+		multiWrite   ReducerMultiWriteMode
+		drainPolicy  DrainPolicy
+		sourceBuffer int
+		pool         *Pool
+		maxItems     int
+		shutdown     time.Duration
+		stats        *runStats
+		panicPolicy  WorkerPanicPolicy
+		semaphore    int
+		scaler       <-chan int
+		maxWorkers   int
+		weight       func(item any) int
+		latency      func(d time.Duration)
+		warmup       time.Duration
+		pressure     backpressure
+		progress     chan<- int
+		scheduleHook func()
+		sentinel     func(item any) bool
+		closedCheck  bool
+		itemTimeout  time.Duration
+		workerInit   func() any
+		workerExit   func(value any)
+		startHook    func()
+		stopHook     func(err error)
 	}
 
 	// Writer interface wraps Write method.
 	Writer[T any] interface {
 		Write(v T)
 	}
+
+	// CheckedWriter interface wraps Write and WriteOK methods.
+	// WriteOK returns false if v is dropped because the processing is cancelled.
+	// The writers passed to mappers and reducers implement it.
+	CheckedWriter[T any] interface {
+		Writer[T]
+		WriteOK(v T) bool
+	}
 )
 
+// Any runs fns parallelly, returns nil as soon as any of fns succeeds,
+// the fns not started yet are skipped. The errors are joined if all fns fail.
+func Any(fns ...func() error) error {
+	ctxFns := make([]func(ctx context.Context) error, len(fns))
+	for i, fn := range fns {
+		if fn == nil {
+			return ErrNilFunc
+		}
+
+		ctxFns[i] = func(ctx context.Context) error {
+			return fn()
+		}
+	}
+
+	return AnyCtx(context.Background(), ctxFns...)
+}
+
+// AnyCtx runs fns parallelly with ctx, returns nil as soon as any of fns succeeds.
+// The ctx passed to fns is derived from ctx, and cancelled after the first success,
+// so that the running fns can stop early. The errors are joined if all fns fail,
+// and the cause of ctx is returned if ctx is done before any success.
+func AnyCtx(ctx context.Context, fns ...func(ctx context.Context) error) error {
+	if len(fns) == 0 {
+		return nil
+	}
+	for _, fn := range fns {
+		if fn == nil {
+			return ErrNilFunc
+		}
+	}
+
+	errs, err := MapReduceCtx(func(source chan<- func(ctx context.Context) error) {
+		for _, fn := range fns {
+			source <- fn
+		}
+	}, func(ctx context.Context, fn func(ctx context.Context) error, writer Writer[error], cancel func(error)) {
+		if err := fn(ctx); err != nil {
+			writer.Write(err)
+			return
+		}
+
+		// cancel is latched once, the first success wins
+		cancel(errSucceeded)
+	}, func(ctx context.Context, pipe <-chan error, writer Writer[[]error], cancel func(error)) {
+		var errs []error
+		for err := range pipe {
+			errs = append(errs, err)
+		}
+		writer.Write(errs)
+	}, WithContext(ctx), WithWorkers(len(fns)))
+	if errors.Is(err, errSucceeded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+// CountVoid runs the processing with a no-op mapper, and returns the number of the elements
+// generated from given generate. The options like WithWorkers are applied as in ForEach,
+// and the elements not mapped because of cancelling or WithMaxItems are not counted.
+func CountVoid[T any](generate GenerateFunc[T], opts ...Option) int {
+	var count int64
+	ForEach(generate, func(item T) {
+		atomic.AddInt64(&count, 1)
+	}, opts...)
+	return int(atomic.LoadInt64(&count))
+}
+
 // Finish runs fns parallelly, cancelled on any error.
 func Finish(fns ...func() error) error {
 	if len(fns) == 0 {
 		return nil
 	}
+	for _, fn := range fns {
+		if fn == nil {
+			return ErrNilFunc
+		}
+	}
+
+	return ForEachErr(func(source chan<- func() error) {
+		for _, fn := range fns {
+			source <- fn
+		}
+	}, func(fn func() error) error {
+		return fn()
+	}, WithWorkers(len(fns)))
+}
+
+// FinishCtx runs fns parallelly with ctx, cancelled on any error or ctx done.
+// The ctx passed to fns is derived from ctx, and also cancelled on the first error,
+// so that the running fns can stop early.
+func FinishCtx(ctx context.Context, fns ...func(ctx context.Context) error) error {
+	if len(fns) == 0 {
+		return nil
+	}
+	for _, fn := range fns {
+		if fn == nil {
+			return ErrNilFunc
+		}
+	}
 
-	return MapReduceVoid(func(source chan<- func() error) {
+	_, err := MapReduceCtx(func(source chan<- func(ctx context.Context) error) {
 		for _, fn := range fns {
 			source <- fn
 		}
-	}, func(fn func() error, writer Writer[any], cancel func(error)) {
-		if err := fn(); err != nil {
+	}, func(ctx context.Context, fn func(ctx context.Context) error, writer Writer[any], cancel func(error)) {
+		if err := fn(ctx); err != nil {
 			cancel(err)
 		}
-	}, func(pipe <-chan any, cancel func(error)) {
-	}, WithWorkers(len(fns)))
+	}, func(ctx context.Context, pipe <-chan any, writer Writer[struct{}], cancel func(error)) {
+		// wait for all fns to be finished
+		drain(pipe)
+		writer.Write(struct{}{})
+	}, WithContext(ctx), WithWorkers(len(fns)))
+	return err
 }
 
 // FinishVoid runs fns parallelly.
@@ -82,6 +401,11 @@ func FinishVoid(fns ...func()) {
 	if len(fns) == 0 {
 		return
 	}
+	for _, fn := range fns {
+		if fn == nil {
+			panic(ErrNilFunc)
+		}
+	}
 
 	ForEach(func(source chan<- func()) {
 		for _, fn := range fns {
@@ -94,9 +418,39 @@ func FinishVoid(fns ...func()) {
 
 // ForEach maps all elements from given generate but no output.
 func ForEach[T any](generate GenerateFunc[T], mapper ForEachFunc[T], opts ...Option) {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	forEachWithPanicChan(source, panicChan, mapper, options)
+}
+
+// ForEachIndexed maps all elements from given generate but no output,
+// the index passed to mapper is the position of the element in the order of generation.
+// The indexes are unique and contiguous from 0, but mappers might see them out of order.
+func ForEachIndexed[T any](generate GenerateFunc[T], mapper func(index int, item T), opts ...Option) {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
 	options := buildOptions(opts...)
-	panicChan := &onceChan{channel: make(chan any)}
-	source := buildSource(generate, panicChan)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := indexSource(buildSource(generate, panicChan, options))
+	options.weight = unwrapWeight(options.weight, func(item indexedItem[T]) any {
+		return item.item
+	})
+	forEachWithPanicChan(source, panicChan, func(item indexedItem[T]) {
+		mapper(item.index, item.item)
+	}, options)
+}
+
+// forEachWithPanicChan maps all elements from source but no output.
+func forEachWithPanicChan[T any](source <-chan T, panicChan *onceChan, mapper ForEachFunc[T],
+	options *mapReduceOptions) {
+	defer options.cancel()
 	collector := make(chan any)
 	done := make(chan struct{})
 
@@ -105,17 +459,37 @@ func ForEach[T any](generate GenerateFunc[T], mapper ForEachFunc[T], opts ...Opt
 		mapper: func(item T, _ Writer[any]) {
 			mapper(item)
 		},
-		source:    source,
-		panicChan: panicChan,
-		collector: collector,
-		doneChan:  done,
-		workers:   options.workers,
+		source:     source,
+		panicChan:  panicChan,
+		collector:  collector,
+		doneChan:   done,
+		workers:    options.workers,
+		rateLimit:  options.rateLimit,
+		metrics:    options.metrics,
+		sequential: options.sequential,
+		pool:       options.pool,
+		maxItems:   options.maxItems,
+		skipPanic:  skipPanic(options),
+		semaphore:  options.semaphore,
+		scaler:     options.scaler,
+		maxWorkers: options.maxWorkers,
+		weight:     options.weight,
+		latency:    options.latency,
+		warmup:     options.warmup,
+		pressure:   options.pressure,
+		progress:   options.progress,
+		guard:      newCloseGuard(options),
+		onSchedule: options.scheduleHook,
+		workerInit: options.workerInit,
+		workerExit: options.workerExit,
 	})
 
 	for {
 		select {
 		case v := <-panicChan.channel:
-			panic(v)
+			// the error is dropped, because ForEach has no output,
+			// mappers stop being scheduled after panicking.
+			_ = handlePanic(options, v)
 		case _, ok := <-collector:
 			if !ok {
 				return
@@ -124,99 +498,456 @@ func ForEach[T any](generate GenerateFunc[T], mapper ForEachFunc[T], opts ...Opt
 	}
 }
 
+// ForEachErr maps all elements from given generate with fn, cancelled on any error.
+func ForEachErr[T any](generate GenerateFunc[T], fn func(item T) error, opts ...Option) error {
+	if fn == nil {
+		return ErrNilFunc
+	}
+
+	return MapReduceVoid(generate, func(item T, writer Writer[any], cancel func(error)) {
+		if err := fn(item); err != nil {
+			cancel(err)
+		}
+	}, func(pipe <-chan any, cancel func(error)) {
+		// wait for all elements to be processed
+		drain(pipe)
+	}, opts...)
+}
+
 // MapReduce maps all elements generated from given generate func,
 // and reduces the output elements with given reducer.
 func MapReduce[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
 	opts ...Option) (V, error) {
-	panicChan := &onceChan{channel: make(chan any)}
-	source := buildSource(generate, panicChan)
-	return mapReduceWithPanicChan(source, panicChan, mapper, reducer, opts...)
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapReduceWithPanicChan(source, panicChan, withoutCtxMapper(mapper), withoutCtxReducer(reducer), options)
+}
+
+// BatchMapReduce maps the batches of the elements generated from given generate func,
+// and reduces the output elements with given reducer.
+// The batch size is customized by WithBatch, the last batch might be smaller.
+func BatchMapReduce[T, U, V any](generate GenerateFunc[T], mapper BatchMapperFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) (V, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildBatches(buildSource(generate, panicChan, options), options.batchSize)
+	return mapReduceWithPanicChan(source, panicChan, withoutCtxMapper(MapperFunc[[]T, U](mapper)),
+		withoutCtxReducer(reducer), options)
 }
 
 // MapReduceChan maps all elements from source, and reduce the output elements with given reducer.
+// The source is not drained if the processing is cancelled, the sender of source should stop by itself.
+// The source is read until the sentinel customized by WithSentinel if any, even if it's never closed.
 func MapReduceChan[T, U, V any](source <-chan T, mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
 	opts ...Option) (V, error) {
-	panicChan := &onceChan{channel: make(chan any)}
-	return mapReduceWithPanicChan(source, panicChan, mapper, reducer, opts...)
+	if source == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	return mapReduceWithPanicChan(withSentinel(source, options), panicChan, withoutCtxMapper(mapper),
+		withoutCtxReducer(reducer), options)
 }
 
-// mapReduceWithPanicChan maps all elements from source, and reduce the output elements with given reducer.
-func mapReduceWithPanicChan[T, U, V any](source <-chan T, panicChan *onceChan, mapper MapperFunc[T, U],
-	reducer ReducerFunc[U, V], opts ...Option) (val V, err error) {
+// MapReduceCtx maps all elements generated from given generate func,
+// and reduces the output elements with given reducer.
+// The ctx passed to reducer is the one customized by WithContext, and the ctx passed to mapper
+// is derived from it, which is also cancelled with the cause once the processing is cancelled.
+func MapReduceCtx[T, U, V any](generate GenerateFunc[T], mapper MapperCtxFunc[T, U], reducer ReducerCtxFunc[U, V],
+	opts ...Option) (V, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
 	options := buildOptions(opts...)
-	// output is used to write the final result
-	output := make(chan V)
-	defer func() {
-		// reducer can only write once, if more, panic
-		for range output {
-			panic("more than one element written in reducer")
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapReduceWithPanicChan(source, panicChan, mapper, reducer, options)
+}
+
+// MapReduceErr maps all elements generated from given generate func,
+// and reduces the output elements with given reducer.
+// The elements failed in mapper are retried as customized by WithRetry.
+func MapReduceErr[T, U, V any](generate GenerateFunc[T], mapper MapperErrFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) (V, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapReduceWithPanicChan(source, panicChan, func(ctx context.Context, item T, writer Writer[U],
+		cancel func(error)) {
+		if err := retry(ctx, options, func() error {
+			return mapper(item, writer)
+		}); err != nil {
+			cancel(err)
 		}
-	}()
+	}, withoutCtxReducer(reducer), options)
+}
+
+// MapReduceGen maps all elements generated from given generate func,
+// and reduces the output elements with given reducer.
+// If generate returns an error, the processing is cancelled with it in PhaseGenerate,
+// the elements sent before are dropped if not reduced yet.
+func MapReduceGen[T, U, V any](generate GenerateFuncErr[T], mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) (V, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+
+	options := buildOptions(opts...)
+	// the generate error cancels ctx before source is closed, so the reducer output is dropped
+	ctx, cancel := context.WithCancelCause(options.ctx)
+	defer cancel(nil)
+	options.ctx = ctx
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(func(source chan<- T) {
+		if err := generate(source); err != nil {
+			err = newCancelError(options.name, PhaseGenerate, err)
+			logError(options, "mapreduce cancelled", PhaseGenerate, slog.Any("error", err))
+			cancel(err)
+		}
+	}, panicChan, options)
+	return mapReduceWithPanicChan(source, panicChan, withoutCtxMapper(mapper), withoutCtxReducer(reducer), options)
+}
+
+// MapReduceInto maps all elements generated from given generate func,
+// and reduces the output elements with given reducer, which can write multiple values into out.
+// out is closed after the reducer returns. If the processing fails, the error is returned,
+// the further writes of reducer are dropped, and out might be closed after returning.
+// The caller must consume out concurrently, otherwise the reducer blocks.
+func MapReduceInto[T, U, V any](out chan<- V, generate GenerateFunc[T], mapper MapperFunc[T, U],
+	reducer ReducerFunc[U, V], opts ...Option) error {
+	if out == nil {
+		return ErrNilFunc
+	}
+	if generate == nil || mapper == nil || reducer == nil {
+		close(out)
+		return ErrNilFunc
+	}
+
+	// quit is closed to drop the writes into out after returning
+	quit := make(chan struct{})
+	reduced := make(chan struct{})
+	_, err := MapReduce(generate, mapper, func(pipe <-chan U, writer Writer[struct{}], cancel func(error)) {
+		defer close(reduced)
+		reducer(pipe, newGuardedWriter(context.Background(), out, quit), cancel)
+		// write a placeholder to avoid ErrReduceNoOutput, same as MapReduceVoid.
+		writer.Write(struct{}{})
+	}, opts...)
+	close(quit)
+	if err != nil {
+		// the reducer might be still running if cancelled, don't wait for the in-flight mappers
+		go func() {
+			<-reduced
+			close(out)
+		}()
+		return err
+	}
 
+	<-reduced
+	close(out)
+	return nil
+}
+
+// mapReduceWithPanicChan maps all elements from source, and reduce the output elements with given reducer.
+func mapReduceWithPanicChan[T, U, V any](source <-chan T, panicChan *onceChan, mapper MapperCtxFunc[T, U],
+	reducer ReducerCtxFunc[U, V], options *mapReduceOptions) (val V, err error) {
+	if options.startHook != nil {
+		options.startHook()
+	}
+	if options.stopHook != nil {
+		// registered first to run last, so that the final error is passed, even if panicking
+		defer func() {
+			options.stopHook(err)
+		}()
+	}
+	defer options.cancel()
+	// output is used to write the final result
+	output := make(chan V)
 	// collector is used to collect data from mapper, and consume in reducer
-	collector := make(chan U, options.workers)
+	collector := make(chan U, options.bufferSize)
 	// if done is closed, all mappers and reducer should stop processing
 	done := make(chan struct{})
-	writer := newGuardedWriter(options.ctx, output, done)
 	var closeOnce sync.Once
-	// use atomic.Value to avoid data race
-	var retErr atomic.Value
+	// retErr keeps the error stopping the processing, a pointer to be stored with any error type,
+	// the aborting error overrides the graceful cancelling one.
+	var retErr atomic.Pointer[error]
+	storeErr := func(err error) {
+		retErr.Store(&err)
+	}
 	finish := func() {
 		closeOnce.Do(func() {
 			close(done)
-			close(output)
 		})
 	}
-	cancel := once(func(err error) {
-		if err != nil {
-			retErr.Store(err)
-		} else {
-			retErr.Store(ErrCancelWithNil)
+	var cleaned chan struct{}
+	if options.workerExit != nil {
+		// the cleanups are done before returning, even if the in-flight mappers are not waited for otherwise.
+		// It's deferred before waiting for reducer, so done is closed before waiting for the mappers.
+		cleaned = make(chan struct{})
+		defer func() {
+			<-cleaned
+		}()
+	}
+	// errs is used to collect all the errors if allErrors is enabled
+	var errs []error
+	var errsLock sync.Mutex
+	defer func() {
+		// reducer can only write once, if more, handle the extra values as customized
+		var last V
+		var multiWritten bool
+		if r, ok := waitForReducer(output, done, panicChan, func(v V) {
+			if options.multiWrite == ReducerMultiWritePanic {
+				// unblock the further writes of reducer before panicking
+				finish()
+				panic(ErrReducerMultiWrite.Error())
+			}
+
+			last = v
+			multiWritten = true
+		}); ok {
+			finish()
+			var zero V
+			val = zero
+			err = handlePanic(options, r)
+			return
+		}
+
+		if multiWritten && err == nil {
+			switch options.multiWrite {
+			case ReducerMultiWriteError:
+				var zero V
+				val = zero
+				err = newCancelError(options.name, PhaseReduce, ErrReducerMultiWrite)
+			case ReducerMultiWriteLast:
+				val = last
+			}
+		}
+
+		// if not cancelled, all mappers and reducer are finished here, so all errors are collected
+		errsLock.Lock()
+		defer errsLock.Unlock()
+		if len(errs) > 0 && err == nil {
+			var zero V
+			val = zero
+			err = errors.Join(errs...)
 		}
+	}()
 
-		drain(source)
+	writer := newGuardedWriter(options.ctx, output, done)
+	// mapperCtx is cancelled on aborting, so that the long-running mappers can stop their own work
+	mapperCtx, cancelMappers := context.WithCancelCause(options.ctx)
+	defer cancelMappers(nil)
+	if options.ctx.Value(globalLimitKey{}) != nil {
+		// the nested processings started with mapperCtx run on the tokens of the mappers
+		mapperCtx = context.WithValue(mapperCtx, lentTokenKey{}, struct{}{})
+	}
+	abort := once(func(err error) {
+		if options.onError != nil {
+			options.onError(err)
+		}
+		storeErr(err)
+		cancelMappers(err)
+		// the generate funcs watching QuitChan stop early, the source is not drained after finishing,
+		// so that cancelling never hangs on an endless generate func.
+		quitSource(source)
 		finish()
 	})
+	cancel := abort
+	// stop is closed to stop scheduling new mappers if cancelled gracefully or with ErrStop
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopScheduling := func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+	}
+	if options.drainPolicy == DrainPolicyGraceful {
+		// the in-flight mappers and reducer keep running, done is closed after reducer returns
+		cancel = once(func(err error) {
+			if options.onError != nil {
+				options.onError(err)
+			}
+			storeErr(err)
+			stopScheduling()
+		})
+	}
+	if options.allErrors {
+		cancel = func(err error) {
+			if options.onError != nil {
+				options.onError(err)
+			}
+			errsLock.Lock()
+			errs = append(errs, err)
+			errsLock.Unlock()
+		}
+	}
+	// mapperCancel and reducerCancel record the phase that cancel is called in
+	mapperCancel := func(err error) {
+		if errors.Is(err, ErrStop) {
+			stopScheduling()
+			return
+		}
+		if options.errorFilter != nil && !options.errorFilter(err) {
+			return
+		}
+
+		err = newCancelError(options.name, PhaseMap, err)
+		options.stats.cancel()
+		logError(options, "mapreduce cancelled", PhaseMap, slog.Any("error", err))
+		cancel(err)
+	}
+	reducerCancel := func(err error) {
+		if errors.Is(err, ErrStop) {
+			stopScheduling()
+			return
+		}
+
+		err = newCancelError(options.name, PhaseReduce, err)
+		options.stats.cancel()
+		logError(options, "mapreduce cancelled", PhaseReduce, slog.Any("error", err))
+		cancel(err)
+	}
 
 	go func() {
 		defer func() {
 			drain(collector)
 			if r := recover(); r != nil {
-				panicChan.write(r)
+				panicChan.write(PhaseReduce, r)
 			}
+			// output is only written by reducer, so close it here to avoid sending on closed channel
+			close(output)
 			finish()
 		}()
 
-		reducer(collector, writer, cancel)
+		reducer(options.ctx, collector, writer, reducerCancel)
 	}()
 
+	var onStop func(inFlight func() int)
+	if options.shutdown > 0 {
+		onStop = func(inFlight func() int) {
+			go func() {
+				// the in-flight mappers are only waited for if cancelled gracefully or with ErrStop,
+				// otherwise done is closed either on aborting or after a normal finish.
+				select {
+				case <-done:
+					return
+				case <-stop:
+				}
+
+				timer := time.NewTimer(options.shutdown)
+				defer timer.Stop()
+
+				select {
+				case <-done:
+				case <-timer.C:
+					logError(options, "mapreduce shutdown timeout", PhaseMap, slog.Int("leaked", inFlight()))
+					// keep the error cancelling gracefully if any
+					if e := retErr.Load(); e != nil {
+						abort(errors.Join(*e, ErrShutdownTimeout))
+					} else {
+						abort(ErrShutdownTimeout)
+					}
+				}
+			}()
+		}
+	}
+
+	runMapper := func(ctx context.Context, item T, w Writer[U]) {
+		if options.itemTimeout <= 0 {
+			mapper(ctx, item, w, mapperCancel)
+			return
+		}
+
+		ctx, cancelTimeout := context.WithTimeoutCause(ctx, options.itemTimeout, ErrMapperTimeout)
+		defer cancelTimeout()
+		mapper(ctx, item, w, mapperCancel)
+		if errors.Is(context.Cause(ctx), ErrMapperTimeout) {
+			mapperCancel(ErrMapperTimeout)
+		}
+	}
+	var withWorker func(value any, item T, w Writer[U])
+	if options.workerInit != nil {
+		withWorker = func(value any, item T, w Writer[U]) {
+			runMapper(context.WithValue(mapperCtx, workerValueKey{}, value), item, w)
+		}
+	}
 	go executeMappers(mapperContext[T, U]{
 		ctx: options.ctx,
 		mapper: func(item T, w Writer[U]) {
-			mapper(item, w, cancel)
+			runMapper(mapperCtx, item, w)
 		},
-		source:    source,
-		panicChan: panicChan,
-		collector: collector,
-		doneChan:  done,
-		workers:   options.workers,
+		withWorker: withWorker,
+		cleaned:    cleaned,
+		source:     source,
+		panicChan:  panicChan,
+		collector:  collector,
+		doneChan:   done,
+		stopChan:   stop,
+		workers:    options.workers,
+		rateLimit:  options.rateLimit,
+		metrics:    options.metrics,
+		sequential: options.sequential,
+		pool:       options.pool,
+		maxItems:   options.maxItems,
+		skipPanic:  skipPanic(options),
+		semaphore:  options.semaphore,
+		scaler:     options.scaler,
+		maxWorkers: options.maxWorkers,
+		weight:     options.weight,
+		latency:    options.latency,
+		warmup:     options.warmup,
+		pressure:   options.pressure,
+		progress:   options.progress,
+		guard:      newCloseGuard(options),
+		onSchedule: options.scheduleHook,
+		workerInit: options.workerInit,
+		workerExit: options.workerExit,
+		onStop:     onStop,
+		stats:      options.stats,
 	})
 
 	select {
 	case <-options.ctx.Done():
-		cancel(context.DeadlineExceeded)
-		err = context.DeadlineExceeded
+		options.stats.cancel()
+		err = context.Cause(options.ctx)
+		abort(err)
 	case v := <-panicChan.channel:
-		// drain output here, otherwise for loop panic in defer
-		drain(output)
-		panic(v)
+		// stop all mappers and reducer, otherwise for loop may panic in defer
+		finish()
+		err = handlePanic(options, v)
 	case v, ok := <-output:
 		if e := retErr.Load(); e != nil {
-			err = e.(error)
+			err = *e
 		} else if ok {
 			val = v
 		} else {
-			err = ErrReduceNoOutput
+			err = noOutputError(options.ctx)
+		}
+	case <-done:
+		if e := retErr.Load(); e != nil {
+			err = *e
+		} else {
+			err = noOutputError(options.ctx)
 		}
 	}
 
@@ -227,111 +958,1271 @@ func mapReduceWithPanicChan[T, U, V any](source <-chan T, panicChan *onceChan, m
 // and reduce the output elements with given reducer.
 func MapReduceVoid[T, U any](generate GenerateFunc[T], mapper MapperFunc[T, U],
 	reducer VoidReducerFunc[U], opts ...Option) error {
-	_, err := MapReduce(generate, mapper, func(input <-chan U, writer Writer[any], cancel func(error)) {
+	if reducer == nil {
+		return ErrNilFunc
+	}
+
+	_, err := MapReduce(generate, mapper, func(input <-chan U, writer Writer[struct{}], cancel func(error)) {
 		reducer(input, cancel)
+		// write a placeholder to avoid ErrReduceNoOutput,
+		// so that the errors passed to cancel are never swallowed.
+		writer.Write(struct{}{})
 	}, opts...)
-	if errors.Is(err, ErrReduceNoOutput) {
-		return nil
+	return err
+}
+
+// MapReduceVoidWithSource maps all elements from source, and reduce the output elements with given reducer.
+func MapReduceVoidWithSource[T, U any](source <-chan T, mapper MapperFunc[T, U], reducer VoidReducerFunc[U],
+	opts ...Option) error {
+	if reducer == nil {
+		return ErrNilFunc
 	}
 
+	_, err := MapReduceChan(source, mapper, func(input <-chan U, writer Writer[struct{}], cancel func(error)) {
+		reducer(input, cancel)
+		// write a placeholder to avoid ErrReduceNoOutput, same as MapReduceVoid.
+		writer.Write(struct{}{})
+	}, opts...)
 	return err
 }
 
-// WithContext customizes a mapreduce processing accepts a given ctx.
-func WithContext(ctx context.Context) Option {
-	return func(opts *mapReduceOptions) {
-		opts.ctx = ctx
+// MapReduceWithStats maps all elements generated from given generate func,
+// and reduces the output elements with given reducer, the statistics of the processing are returned.
+func MapReduceWithStats[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) (V, Stats, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, Stats{}, ErrNilFunc
 	}
+
+	start := time.Now()
+	options := buildOptions(opts...)
+	options.stats = new(runStats)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	val, err := mapReduceWithPanicChan(source, panicChan, withoutCtxMapper(mapper), withoutCtxReducer(reducer), options)
+	return val, options.stats.snapshot(time.Since(start)), err
 }
 
-// WithWorkers customizes a mapreduce processing with given workers.
-func WithWorkers(workers int) Option {
-	return func(opts *mapReduceOptions) {
-		if workers < minWorkers {
-			opts.workers = minWorkers
-		} else {
-			opts.workers = workers
-		}
+// MapReduceWithProgress maps all elements generated from given generate func,
+// and reduces the output elements with given reducer, which can query the progress of the processing.
+func MapReduceWithProgress[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U],
+	reducer ProgressReducerFunc[U, V], opts ...Option) (V, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		return zero, ErrNilFunc
 	}
-}
 
-func buildOptions(opts ...Option) *mapReduceOptions {
-	options := newOptions()
-	for _, opt := range opts {
-		opt(options)
+	options := buildOptions(opts...)
+	options.stats = new(runStats)
+	var consumed int64
+	progress := func() (int, int) {
+		c := int(atomic.LoadInt64(&consumed))
+		// the element might be received before the mapper counts it as written
+		return max(int(atomic.LoadInt64(&options.stats.mapOut)), c), c
 	}
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapReduceWithPanicChan(source, panicChan, withoutCtxMapper(mapper), func(ctx context.Context,
+		pipe <-chan U, writer Writer[V], cancel func(error)) {
+		counted := make(chan U)
+		go func() {
+			defer close(counted)
+			for item := range pipe {
+				counted <- item
+				atomic.AddInt64(&consumed, 1)
+			}
+		}()
+		// unblock the counting goroutine if reducer returns before pipe is drained
+		defer drain(counted)
 
-	return options
+		reducer(counted, writer, cancel, progress)
+	}, options)
 }
 
-func buildSource[T any](generate GenerateFunc[T], panicChan *onceChan) chan T {
-	source := make(chan T)
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				panicChan.write(r)
-			}
-			close(source)
-		}()
+// MapReduceWithErrors maps all elements generated from given generate func,
+// and reduces the output elements with given reducer. The elements failed in mapper are skipped
+// without cancelling the processing, and their errors are returned in the channel, which is closed.
+// The returned error is only for the failed processing, like cancelled by reducer or panicked.
+func MapReduceWithErrors[T, U, V any](generate GenerateFunc[T], mapper func(item T) (U, error),
+	reducer ReducerFunc[U, V], opts ...Option) (V, <-chan error, error) {
+	if generate == nil || mapper == nil || reducer == nil {
+		var zero V
+		errChan := make(chan error)
+		close(errChan)
+		return zero, errChan, ErrNilFunc
+	}
 
-		generate(source)
-	}()
+	var errs []error
+	var lock sync.Mutex
+	val, err := MapReduce(generate, func(item T, writer Writer[U], cancel func(error)) {
+		v, err := mapper(item)
+		if err != nil {
+			lock.Lock()
+			errs = append(errs, err)
+			lock.Unlock()
+			return
+		}
 
-	return source
-}
+		writer.Write(v)
+	}, reducer, opts...)
 
-// drain drains the channel.
-func drain[T any](channel <-chan T) {
-	// drain the channel
-	for range channel {
+	lock.Lock()
+	defer lock.Unlock()
+	// the errors are all collected after processing, so the channel never blocks the mappers
+	errChan := make(chan error, len(errs))
+	for _, e := range errs {
+		errChan <- e
 	}
+	close(errChan)
+	return val, errChan, err
 }
 
-func executeMappers[T, U any](mCtx mapperContext[T, U]) {
-	var wg sync.WaitGroup
-	defer func() {
-		wg.Wait()
-		close(mCtx.collector)
-		drain(mCtx.source)
-	}()
+// MapReduceSlice maps all elements generated from given generate,
+// and collects all the output elements into a slice.
+// The order of the output elements is not guaranteed.
+// If the processing fails, the elements collected before failing are returned with the error,
+// which might be partial.
+func MapReduceSlice[T, U any](generate GenerateFunc[T], mapper MapperFunc[T, U], opts ...Option) ([]U, error) {
+	// partial is shared with the caller if failed, because the reducer might not be finished yet.
+	var partial []U
+	var lock sync.Mutex
+	result, err := MapReduce(generate, mapper, func(pipe <-chan U, writer Writer[[]U], cancel func(error)) {
+		for item := range pipe {
+			lock.Lock()
+			partial = append(partial, item)
+			lock.Unlock()
+		}
 
-	var failed int32
+		lock.Lock()
+		defer lock.Unlock()
+		writer.Write(partial)
+	}, opts...)
+	if err != nil {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]U(nil), partial...), err
+	}
+
+	return result, nil
+}
+
+// MapTakeN maps the elements generated from given generate, and collects the first n output elements
+// into a slice, then stops scheduling new mappers, like finding any n matching records.
+// The output elements of the in-flight mappers after n collected are dropped.
+// All the output elements are returned if fewer than n are produced. Non-positive n returns nothing.
+// If the processing fails, the elements collected before failing are returned with the error.
+func MapTakeN[T, U any](generate GenerateFunc[T], mapper MapperFunc[T, U], n int, opts ...Option) ([]U, error) {
+	if generate == nil || mapper == nil {
+		return nil, ErrNilFunc
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	// taken is shared with the caller if failed, because the reducer might not be finished yet.
+	var taken []U
+	var lock sync.Mutex
+	result, err := MapReduce(generate, mapper, func(pipe <-chan U, writer Writer[[]U], cancel func(error)) {
+		for item := range pipe {
+			lock.Lock()
+			if len(taken) < n {
+				taken = append(taken, item)
+				if len(taken) == n {
+					cancel(ErrStop)
+				}
+			}
+			lock.Unlock()
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		writer.Write(taken)
+	}, opts...)
+	if err != nil {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]U(nil), taken...), err
+	}
+
+	return result, nil
+}
+
+// MustFinish runs fns parallelly like Finish, and panics if any of fns returns an error.
+// The panic value is an error wrapping the returned error.
+func MustFinish(fns ...func() error) {
+	if err := Finish(fns...); err != nil {
+		panic(fmt.Errorf("mapreduce: %w", err))
+	}
+}
+
+// MustMapReduce is like MapReduce, but panics if the processing fails, which is handy for scripts and tests.
+// The panic value is an error wrapping the returned error.
+func MustMapReduce[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) V {
+	val, err := MapReduce(generate, mapper, reducer, opts...)
+	if err != nil {
+		panic(fmt.Errorf("mapreduce: %w", err))
+	}
+
+	return val
+}
+
+// ResolveOptions returns the effective configuration resolved from opts, which is handy for
+// debugging the misconfigurations, like the clamped workers.
+func ResolveOptions(opts ...Option) Options {
+	options := buildOptions(opts...)
+	// release the ctx created for WithTimeout
+	defer options.cancel()
+
+	return Options{
+		Name:         options.name,
+		Workers:      options.workers,
+		MaxWorkers:   options.maxWorkers,
+		BufferSize:   options.bufferSize,
+		SourceBuffer: options.sourceBuffer,
+		Timeout:      options.timeout,
+		Cancellable:  options.ctx.Done() != nil,
+		Sequential:   options.sequential,
+	}
+}
+
+// WithAllErrors customizes a mapreduce processing to collect all the errors passed to cancel,
+// instead of stopping on the first one. The returned error joins all the collected errors.
+func WithAllErrors() Option {
+	return func(opts *mapReduceOptions) {
+		opts.allErrors = true
+	}
+}
+
+// WithBackpressureHook customizes a mapreduce processing to call hook with true if a mapper is blocked
+// on writing longer than threshold, because the reducer is slower than the mappers, and with false after
+// the write is unblocked or dropped. hook is called by each blocked mapper concurrently.
+func WithBackpressureHook(threshold time.Duration, hook func(waiting bool)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.pressure = backpressure{
+			threshold: threshold,
+			hook:      hook,
+		}
+	}
+}
+
+// WithBatch customizes a mapreduce processing to group at most size elements into a batch.
+// It only works with BatchMapReduce, non-positive size means 1, which is the default.
+func WithBatch(size int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.batchSize = size
+	}
+}
+
+// WithBufferSize customizes a mapreduce processing with given collector buffer size.
+// Negative size falls back to the default, which is the same as the workers.
+func WithBufferSize(size int) Option {
+	return func(opts *mapReduceOptions) {
+		if size >= 0 {
+			opts.bufferSize = size
+		}
+	}
+}
+
+// WithCollectorClosedCheck customizes a mapreduce processing to detect the writes after all the mappers returned,
+// like the ones from the goroutines started by mappers. The late write is dropped and reported as
+// ErrWriteAfterClose with the value to the logger and the func customized by WithOnError,
+// instead of panicking on sending to closed channel. It's meant for debugging, because every write
+// takes a lock.
+func WithCollectorClosedCheck() Option {
+	return func(opts *mapReduceOptions) {
+		opts.closedCheck = true
+	}
+}
+
+// WithContext customizes a mapreduce processing accepts a given ctx.
+func WithContext(ctx context.Context) Option {
+	return func(opts *mapReduceOptions) {
+		opts.ctx = ctx
+	}
+}
+
+// WithDrainPolicy customizes a mapreduce processing to handle the in-flight mappers
+// with given policy if cancelled, DrainPolicyAbort is the default.
+// It doesn't work with WithAllErrors, which never stops scheduling.
+func WithDrainPolicy(policy DrainPolicy) Option {
+	return func(opts *mapReduceOptions) {
+		opts.drainPolicy = policy
+	}
+}
+
+// WithErrorFilter customizes a mapreduce processing to cancel only if fn returns true
+// with the error passed to cancel in mapper, otherwise the error is dropped and processing continues.
+func WithErrorFilter(fn func(err error) bool) Option {
+	return func(opts *mapReduceOptions) {
+		opts.errorFilter = fn
+	}
+}
+
+// WithLatencyRecorder customizes a mapreduce processing to call fn with the duration of each mapper call,
+// such as feeding a histogram. fn is called concurrently, and also called if the mapper panics.
+func WithLatencyRecorder(fn func(d time.Duration)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.latency = fn
+	}
+}
+
+// WithLogger customizes a mapreduce processing to log the cancellations and panics with l.
+// Nothing is logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(opts *mapReduceOptions) {
+		opts.logger = l
+	}
+}
+
+// WithMapperSemaphore customizes a mapreduce processing to run at most n mappers at the same time,
+// the other workers wait for the running ones, which limits the external resources used by mappers
+// independently of the workers. Non-positive n means no limit, which is the default.
+func WithMapperSemaphore(n int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.semaphore = n
+	}
+}
+
+// WithMapperTimeout customizes a mapreduce processing to run each mapper with a ctx timed out in d,
+// the timed out element cancels the processing with ErrMapperTimeout, use WithErrorFilter to skip it instead.
+// Only the mappers watching ctx, like the ones of MapReduceCtx, can stop on timeout.
+func WithMapperTimeout(d time.Duration) Option {
+	return func(opts *mapReduceOptions) {
+		opts.itemTimeout = d
+	}
+}
+
+// WithMaxItems customizes a mapreduce processing to map at most n elements,
+// the generate func is asked to quit by QuitChan, and the processing finishes normally.
+// Non-positive n means no limit, which is the default.
+func WithMaxItems(n int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.maxItems = n
+	}
+}
+
+// WithMaxWorkers customizes a mapreduce processing to clamp the workers to at most n,
+// which protects from the misconfigured huge workers. The clamping is logged with the logger
+// customized by WithLogger. Non-positive n means the default, which is 65536.
+func WithMaxWorkers(n int) Option {
+	return func(opts *mapReduceOptions) {
+		if n > 0 {
+			opts.maxWorkers = n
+		} else {
+			opts.maxWorkers = defaultMaxWorkers
+		}
+	}
+}
+
+// WithMetrics customizes a mapreduce processing to report the statistics of mappers
+// on each mapper being scheduled and finished. The callback might be called concurrently,
+// and it should be fast enough to not block the processing.
+func WithMetrics(callback func(stat Stat)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.metrics = callback
+	}
+}
+
+// WithName customizes a mapreduce processing with given name, which is included in
+// the returned MapReduceError and the Stat reported to the metrics callback.
+func WithName(name string) Option {
+	return func(opts *mapReduceOptions) {
+		opts.name = name
+	}
+}
+
+// WithOnError customizes a mapreduce processing to call fn with the error that cancels the processing,
+// it's called at most once, or for each error collected if WithAllErrors is used.
+// It's also called for each panic skipped by WorkerPanicSkip, and for the panic stopping
+// the stream functions like Map and Filter.
+// The returned error of the processing is not changed.
+func WithOnError(fn func(err error)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.onError = fn
+	}
+}
+
+// WithPanicHandler customizes a mapreduce processing to convert the panics in generate,
+// mapper or reducer into the returned error with given handler, instead of panicking.
+// For the functions without returning error, like ForEach and Filter,
+// the processing stops after the handler is called.
+// The stream functions like Map and Filter never panic in their internal goroutines,
+// they stop and close the returned channel even without the handler.
+func WithPanicHandler(handler PanicHandlerFunc) Option {
+	return func(opts *mapReduceOptions) {
+		opts.panicHandler = handler
+	}
+}
+
+// WithPool customizes a mapreduce processing to run mappers on the worker goroutines of p.
+// The concurrency is still limited by WithWorkers. Don't use the same p in mappers, which might deadlock.
+func WithPool(p *Pool) Option {
+	return func(opts *mapReduceOptions) {
+		opts.pool = p
+	}
+}
+
+// WithProgressChan customizes a mapreduce processing to send the cumulative number of the finished mappers
+// into ch after each mapper finished. The sending never blocks, so the updates are dropped if ch is not ready,
+// use a buffered ch to keep more of them. ch is never closed by the processing.
+func WithProgressChan(ch chan<- int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.progress = ch
+	}
+}
+
+// WithRateLimit customizes a mapreduce processing to start at most perSecond mappers per second.
+// Non-positive perSecond means no limit, which is the default.
+func WithRateLimit(perSecond int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.rateLimit = perSecond
+	}
+}
+
+// WithReducerMultiWrite customizes a mapreduce processing to handle the values
+// written by reducer more than once with given mode, ReducerMultiWritePanic is the default.
+func WithReducerMultiWrite(mode ReducerMultiWriteMode) Option {
+	return func(opts *mapReduceOptions) {
+		opts.multiWrite = mode
+	}
+}
+
+// WithRetry customizes a mapreduce processing to try the failed elements at most attempts times,
+// with the backoff duration before each retry. It only works with MapReduceErr.
+func WithRetry(attempts int, backoff func(attempt int) time.Duration) Option {
+	return func(opts *mapReduceOptions) {
+		opts.retries = attempts - 1
+		opts.backoff = backoff
+	}
+}
+
+// WithScaler customizes a mapreduce processing to change the number of workers on the fly,
+// each positive value received from ctrl becomes the new number of workers.
+// Increasing the workers takes effect immediately, while decreasing the workers lets
+// the running mappers finish before scheduling new ones.
+func WithScaler(ctrl <-chan int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.scaler = ctrl
+	}
+}
+
+// WithScheduleHook customizes a mapreduce processing to call fn right before each element is handed to a worker,
+// in the scheduling goroutine. It's meant for testing, such as cancelling at a known scheduling point,
+// the element is not handed to a worker if the processing is cancelled in fn.
+func WithScheduleHook(fn func()) Option {
+	return func(opts *mapReduceOptions) {
+		opts.scheduleHook = fn
+	}
+}
+
+// WithSentinel customizes a mapreduce processing to stop generating when the generate func sends sentinel,
+// the elements before it are processed as normal, and the ones after it are ignored.
+// It's useful for the long-lived sources that can't be closed. eq compares the elements with sentinel,
+// nil eq compares them with ==, which panics if the elements are not comparable.
+func WithSentinel[T any](sentinel T, eq func(a, b T) bool) Option {
+	return func(opts *mapReduceOptions) {
+		opts.sentinel = func(item any) bool {
+			v, ok := item.(T)
+			if !ok {
+				return false
+			}
+			if eq == nil {
+				return any(v) == any(sentinel)
+			}
+
+			return eq(v, sentinel)
+		}
+	}
+}
+
+// WithSequential customizes a mapreduce processing to call mapper synchronously
+// in the order of generation, which makes the processing reproducible for debugging.
+// Unlike WithWorkers(1), no goroutine is started for each element.
+func WithSequential() Option {
+	return func(opts *mapReduceOptions) {
+		opts.sequential = true
+	}
+}
+
+// WithShutdownTimeout customizes a mapreduce processing to wait at most d for the in-flight mappers
+// and reducer to finish after cancelled gracefully or with ErrStop, otherwise ErrShutdownTimeout is returned,
+// joined with the cancelling error if any. A processing finishing without cancelling is never timed out.
+// The leaked mappers and reducer might still be running after returning.
+// It works with the functions returning error, like MapReduce and Finish.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(opts *mapReduceOptions) {
+		opts.shutdown = d
+	}
+}
+
+// WithSourceBuffer customizes a mapreduce processing to buffer at most n generated elements,
+// which bounds how far the generate func can go ahead of the mappers. Default is 0, no buffer.
+func WithSourceBuffer(n int) Option {
+	return func(opts *mapReduceOptions) {
+		if n > 0 {
+			opts.sourceBuffer = n
+		}
+	}
+}
+
+// WithStartHook customizes a mapreduce processing to call fn before processing.
+// Like WithStopHook, it works with the functions returning error, like MapReduce and Finish.
+func WithStartHook(fn func()) Option {
+	return func(opts *mapReduceOptions) {
+		opts.startHook = fn
+	}
+}
+
+// WithStopHook customizes a mapreduce processing to call fn with the returned error after processing,
+// it's called exactly once, even if the processing panics.
+func WithStopHook(fn func(err error)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.stopHook = fn
+	}
+}
+
+// WithTimeout customizes a mapreduce processing to be cancelled after the given timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(opts *mapReduceOptions) {
+		opts.timeout = timeout
+	}
+}
+
+// WithWarmup customizes a mapreduce processing to ramp up the running mappers from 1 to workers in d,
+// the limit doubles in each step, to protect the cold downstreams from the burst on starting.
+func WithWarmup(d time.Duration) Option {
+	return func(opts *mapReduceOptions) {
+		opts.warmup = d
+	}
+}
+
+// WithWeightFunc customizes a mapreduce processing to weigh the elements with fn,
+// the total weight of the elements being mapped is bounded by workers, instead of the number of them.
+// The weight is clamped into [1, workers], and the elements not of type T weigh 1,
+// like the batches of BatchMapReduce. It's ignored if WithScaler is used.
+func WithWeightFunc[T any](fn func(item T) int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.weight = func(item any) int {
+			if v, ok := item.(T); ok {
+				return fn(v)
+			}
+
+			return 1
+		}
+	}
+}
+
+// WithWorkerCleanup customizes a mapreduce processing to call fn once per worker with the value returned
+// by the func customized by WithWorkerInit, after all the mappers returned, even if the processing is cancelled.
+// The processing waits for the in-flight mappers to return on cancelling, so fn is called before returning.
+func WithWorkerCleanup(fn func(value any)) Option {
+	return func(opts *mapReduceOptions) {
+		opts.workerExit = fn
+	}
+}
+
+// WithWorkerInit customizes a mapreduce processing to call fn once per worker before running its first mapper,
+// such as opening a connection for each worker. The value returned by fn is passed to the mappers run by
+// the worker, get it by WorkerValue from the ctx of the mappers in MapReduceCtx, and to the func customized by
+// WithWorkerCleanup. The workers are started lazily and reused, so fn is called as many times as the max number
+// of the mappers running at the same time, which is at most workers.
+func WithWorkerInit(fn func() any) Option {
+	return func(opts *mapReduceOptions) {
+		opts.workerInit = fn
+	}
+}
+
+// WithWorkerPanicPolicy customizes a mapreduce processing to handle the panics in mappers with policy,
+// WorkerPanicAbort is the default. With WorkerPanicSkip, the panics are passed to the callback
+// customized by WithOnError as errors, and the processing continues.
+func WithWorkerPanicPolicy(policy WorkerPanicPolicy) Option {
+	return func(opts *mapReduceOptions) {
+		opts.panicPolicy = policy
+	}
+}
+
+// WithWorkers customizes a mapreduce processing with given workers,
+// which are clamped to the max customized by WithMaxWorkers.
+func WithWorkers(workers int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.workers = clampWorkers(workers)
+		opts.workersFunc = nil
+	}
+}
+
+// WithWorkersFunc customizes a mapreduce processing with the workers returned by fn,
+// fn is called when the mapreduce processing starts.
+func WithWorkersFunc(fn func() int) Option {
+	return func(opts *mapReduceOptions) {
+		opts.workersFunc = fn
+	}
+}
+
+func buildOptions(opts ...Option) *mapReduceOptions {
+	options := newOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.sequential {
+		options.workers = 1
+	} else if options.workersFunc != nil {
+		options.workers = clampWorkers(options.workersFunc())
+	}
+	if options.workers > options.maxWorkers {
+		if options.logger != nil {
+			options.logger.WarnContext(options.ctx, "mapreduce workers clamped",
+				slog.Int("workers", options.workers), slog.Int("max", options.maxWorkers))
+		}
+		options.workers = options.maxWorkers
+	}
+	if options.bufferSize < 0 {
+		options.bufferSize = options.workers
+	}
+	if options.timeout > 0 {
+		options.ctx, options.cancel = context.WithTimeout(options.ctx, options.timeout)
+	}
+	if metrics := options.metrics; metrics != nil && len(options.name) > 0 {
+		options.metrics = func(stat Stat) {
+			stat.Name = options.name
+			metrics(stat)
+		}
+	}
+
+	return options
+}
+
+func clampWorkers(workers int) int {
+	if workers < minWorkers {
+		return minWorkers
+	}
+
+	return workers
+}
+
+// buildSource returns the channel of the elements sent by generate,
+// which is closed after the sentinel customized by WithSentinel if any.
+func buildSource[T any](generate GenerateFunc[T], panicChan *onceChan, options *mapReduceOptions) <-chan T {
+	source := make(chan T, options.sourceBuffer)
+	unregister := registerSource(source)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicChan.write(PhaseGenerate, r)
+			}
+			unregister()
+			close(source)
+		}()
+
+		generate(source)
+	}()
+
+	return withSentinel(source, options)
+}
+
+// withSentinel returns source itself, or the channel closed after the sentinel customized by WithSentinel.
+func withSentinel[T any](source <-chan T, options *mapReduceOptions) <-chan T {
+	if options.sentinel == nil {
+		return source
+	}
+
+	return stopAtSentinel(source, options.sentinel)
+}
+
+// stopAtSentinel forwards the elements from source into the returned channel until isSentinel returns true,
+// then the generator is asked to quit. The rest elements are not drained, because the long-lived sources
+// are never closed, the generate funcs not watching QuitChan are left blocked.
+func stopAtSentinel[T any](source <-chan T, isSentinel func(item any) bool) chan T {
+	output := make(chan T)
+	unregister := registerSource(output)
+	go func() {
+		defer func() {
+			unregister()
+			quitSource(source)
+			close(output)
+		}()
+
+		// the consumer of output asks to quit, like being cancelled
+		quit := QuitChan(output)
+		for {
+			select {
+			case <-quit:
+				return
+			case item, ok := <-source:
+				if !ok || isSentinel(item) {
+					return
+				}
+
+				select {
+				case <-quit:
+					return
+				case output <- item:
+				}
+			}
+		}
+	}()
+
+	return output
+}
+
+// buildBatches groups the elements from source into batches with at most size elements.
+func buildBatches[T any](source <-chan T, size int) chan []T {
+	if size < 1 {
+		size = 1
+	}
+
+	batches := make(chan []T)
+	unregister := registerSource(batches)
+	go func() {
+		defer func() {
+			unregister()
+			close(batches)
+		}()
+
+		// the consumer of batches asks to quit, which is passed to the generator
+		quit := QuitChan(batches)
+		defer quitSource(source)
+		send := func(batch []T) bool {
+			select {
+			case <-quit:
+				return false
+			case batches <- batch:
+				return true
+			}
+		}
+
+		batch := make([]T, 0, size)
+		for {
+			select {
+			case <-quit:
+				return
+			case item, ok := <-source:
+				if !ok {
+					if len(batch) > 0 {
+						send(batch)
+					}
+					return
+				}
+
+				batch = append(batch, item)
+				if len(batch) == size {
+					if !send(batch) {
+						return
+					}
+					batch = make([]T, 0, size)
+				}
+			}
+		}
+	}()
+
+	return batches
+}
+
+// isClosed returns true if channel is closed, a nil channel is never closed.
+func isClosed(channel <-chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+// indexedItem is an element with the index in the order of generation.
+type indexedItem[T any] struct {
+	index int
+	item  T
+}
+
+// indexSource attaches the indexes in the order of generation to the elements from source.
+func indexSource[T any](source <-chan T) chan indexedItem[T] {
+	indexed := make(chan indexedItem[T])
+	unregister := registerSource(indexed)
+	go func() {
+		defer func() {
+			unregister()
+			close(indexed)
+		}()
+
+		// the consumer of indexed asks to quit, which is passed to the generator
+		quit := QuitChan(indexed)
+		defer quitSource(source)
+		for index := 0; ; index++ {
+			select {
+			case <-quit:
+				return
+			case item, ok := <-source:
+				if !ok {
+					return
+				}
+
+				select {
+				case <-quit:
+					return
+				case indexed <- indexedItem[T]{index: index, item: item}:
+				}
+			}
+		}
+	}()
+
+	return indexed
+}
+
+// drain drains the channel.
+func drain[T any](channel <-chan T) {
+	// drain the channel
+	for range channel {
+	}
+}
+
+// drainUntil drains the channel until it's closed or done is closed, a nil done is never closed.
+// The generate funcs still sending without watching QuitChan after done closed are left blocked,
+// which never spins on an endless generate func.
+func drainUntil[T any](channel <-chan T, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-channel:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func executeMappers[T, U any](mCtx mapperContext[T, U]) {
+	var wg sync.WaitGroup
+	var failed int32
+	var inFlight, completed int64
+	var scheduled int
 	pool := make(chan struct{}, mCtx.workers)
-	writer := newGuardedWriter(mCtx.ctx, mCtx.collector, mCtx.doneChan)
+	release := func() {
+		<-pool
+	}
+	var scaled *scaledPool
+	if mCtx.scaler != nil {
+		scaled = newScaledPool(mCtx.workers, mCtx.maxWorkers, mCtx.scaler)
+		pool = scaled.admit
+		release = scaled.release
+	}
+	releaseN := func(n int) {
+		for i := 0; i < n; i++ {
+			release()
+		}
+	}
+	// acquire takes n more capacity of pool for a weighted element, it's only called by the scheduling loop,
+	// so partial acquiring can't deadlock with the others. The acquired capacity is released if failed.
+	acquire := func(n int) bool {
+		for i := 0; i < n; i++ {
+			select {
+			case <-mCtx.ctx.Done():
+			case <-mCtx.doneChan:
+			case <-mCtx.stopChan:
+			case pool <- struct{}{}:
+				continue
+			}
+
+			releaseN(i)
+			return false
+		}
+
+		return true
+	}
+	var workers workerSet
+	defer func() {
+		if mCtx.onStop != nil {
+			mCtx.onStop(func() int {
+				return int(atomic.LoadInt64(&inFlight))
+			})
+		}
+		// let the generators stop early, the rest elements are drained until done
+		quitSource(mCtx.source)
+		wg.Wait()
+		if scaled != nil {
+			scaled.stop()
+		}
+		if mCtx.workerExit != nil {
+			for _, value := range workers.created {
+				mCtx.workerExit(value)
+			}
+		}
+		if mCtx.cleaned != nil {
+			close(mCtx.cleaned)
+		}
+		if mCtx.guard != nil {
+			mCtx.guard.close(func() {
+				close(mCtx.collector)
+			})
+		} else {
+			close(mCtx.collector)
+		}
+		drainUntil(mCtx.source, mCtx.doneChan)
+	}()
+
+	report := func() {
+		if mCtx.metrics != nil {
+			mCtx.metrics(Stat{
+				InFlight:   int(atomic.LoadInt64(&inFlight)),
+				Completed:  int(atomic.LoadInt64(&completed)),
+				QueueDepth: len(mCtx.collector),
+			})
+		}
+	}
+	var semaphore chan struct{}
+	if mCtx.semaphore > 0 {
+		semaphore = make(chan struct{}, mCtx.semaphore)
+	}
+	limiter := newRateLimiter(mCtx.rateLimit)
+	global := newGlobalGate(mCtx.ctx)
+	warmup := newWarmupGate(mCtx.workers, mCtx.warmup)
+	guarded := newGuardedWriter(mCtx.ctx, mCtx.collector, mCtx.doneChan)
+	guarded.pressure = mCtx.pressure
+	guarded.guard = mCtx.guard
+	var writer CheckedWriter[U] = guarded
+	if mCtx.stats != nil {
+		writer = countingWriter[U]{
+			writer:  writer,
+			counter: &mCtx.stats.mapOut,
+		}
+	}
 	for atomic.LoadInt32(&failed) == 0 {
 		select {
 		case <-mCtx.ctx.Done():
 			return
 		case <-mCtx.doneChan:
 			return
+		case <-mCtx.stopChan:
+			return
 		case pool <- struct{}{}:
 			item, ok := <-mCtx.source
+			if !ok || isClosed(mCtx.doneChan) || isClosed(mCtx.stopChan) {
+				release()
+				return
+			}
+			// the weight is computed before acquiring the rest capacity of the element
+			weight := 1
+			if mCtx.weight != nil && scaled == nil {
+				weight = min(max(mCtx.weight(item), 1), mCtx.workers)
+			}
+			if !acquire(weight - 1) {
+				releaseN(1)
+				return
+			}
+			if !warmup.wait(mCtx.ctx, mCtx.doneChan, func() int {
+				return int(atomic.LoadInt64(&inFlight))
+			}) {
+				releaseN(weight)
+				return
+			}
+			if !limiter.wait(mCtx.ctx, mCtx.doneChan) {
+				releaseN(weight)
+				return
+			}
+			if mCtx.onSchedule != nil {
+				mCtx.onSchedule()
+				// the hook might cancel the processing, then the element is not handed to a worker
+				if mCtx.ctx.Err() != nil || isClosed(mCtx.doneChan) || isClosed(mCtx.stopChan) {
+					releaseN(weight)
+					return
+				}
+			}
+			// the token is acquired before starting the mapper, so no goroutine is left waiting for it
+			token, ok := global.acquire(mCtx.ctx, mCtx.doneChan)
 			if !ok {
-				<-pool
+				releaseN(weight)
 				return
 			}
 
 			wg.Add(1)
-			go func() {
+			atomic.AddInt64(&inFlight, 1)
+			report()
+			run := func() {
 				defer func() {
 					if r := recover(); r != nil {
-						atomic.AddInt32(&failed, 1)
-						mCtx.panicChan.write(r)
+						if mCtx.skipPanic != nil {
+							mCtx.skipPanic(r)
+						} else {
+							atomic.AddInt32(&failed, 1)
+							mCtx.panicChan.write(PhaseMap, r)
+						}
+					}
+					atomic.AddInt64(&inFlight, -1)
+					finished := atomic.AddInt64(&completed, 1)
+					warmup.release()
+					if mCtx.progress != nil {
+						// the update is dropped if the receiver is slow, never stalls the processing
+						select {
+						case mCtx.progress <- int(finished):
+						default:
+						}
 					}
+					report()
+					token.release()
+					// release before Done, the scaledPool is stopped after all mappers are done
+					releaseN(weight)
 					wg.Done()
-					<-pool
 				}()
 
-				mCtx.mapper(item, writer)
-			}()
+				if semaphore != nil {
+					// the stale elements are skipped if cancelled while waiting
+					select {
+					case <-mCtx.ctx.Done():
+						return
+					case <-mCtx.doneChan:
+						return
+					case semaphore <- struct{}{}:
+					}
+					defer func() {
+						<-semaphore
+					}()
+				}
+				var worker any
+				if mCtx.workerInit != nil || mCtx.workerExit != nil {
+					worker = workers.take(mCtx.workerInit)
+					defer workers.put(worker)
+				}
+				if mCtx.latency != nil {
+					// the time waiting for semaphore is not counted
+					start := time.Now()
+					defer func() {
+						mCtx.latency(time.Since(start))
+					}()
+				}
+				var w Writer[U] = writer
+				if token != nil {
+					// the reducer might need the token to finish, like starting nested processings
+					w = tokenWriter[U]{
+						writer: writer,
+						token:  token,
+						ctx:    mCtx.ctx,
+						done:   mCtx.doneChan,
+					}
+				}
+				if mCtx.withWorker != nil {
+					mCtx.withWorker(worker, item, w)
+				} else {
+					mCtx.mapper(item, w)
+				}
+			}
+			if mCtx.sequential {
+				run()
+			} else {
+				mCtx.pool.submit(run)
+			}
+
+			scheduled++
+			mCtx.stats.addItem()
+			if mCtx.maxItems > 0 && scheduled >= mCtx.maxItems {
+				// the generate func is asked to quit, the processing finishes normally
+				return
+			}
+		}
+	}
+}
+
+// waitForReducer waits for the reducer to finish or the processing to be cancelled,
+// it returns the recovered panic value if any, and calls extra with the values written more than once.
+func waitForReducer[V any](output <-chan V, done <-chan struct{}, panicChan *onceChan,
+	extra func(v V)) (panicValue, bool) {
+	for {
+		select {
+		case v := <-panicChan.channel:
+			return v, true
+		case <-done:
+			return panicValue{}, false
+		case v, ok := <-output:
+			if !ok {
+				return panicValue{}, false
+			}
+
+			extra(v)
+		}
+	}
+}
+
+// handlePanic panics with v if no panic handler is customized,
+// otherwise it returns the error converted by the panic handler.
+func handlePanic(options *mapReduceOptions, v panicValue) error {
+	logError(options, "mapreduce panicked", v.phase, slog.Any("panic", v.value))
+	if options.panicHandler == nil {
+		panic(v.value)
+	}
+
+	return newPanicError(options, v)
+}
+
+// handleStreamPanic handles the panic of the stream functions like Map and Filter,
+// which have no caller goroutine to panic in, so the panic is logged and passed to onError.
+func handleStreamPanic(options *mapReduceOptions, v panicValue) {
+	logError(options, "mapreduce panicked", v.phase, slog.Any("panic", v.value))
+	err := newPanicError(options, v)
+	if options.onError != nil {
+		options.onError(err)
+	}
+}
+
+// newPanicError returns the error converted from v by the panic handler if any.
+func newPanicError(options *mapReduceOptions, v panicValue) error {
+	var err error
+	if options.panicHandler != nil {
+		err = options.panicHandler(v.value)
+	}
+	if err == nil {
+		err = fmt.Errorf("panic: %v", v.value)
+	}
+
+	return &MapReduceError{
+		Name:       options.name,
+		Phase:      v.phase,
+		Cause:      err,
+		PanicValue: v.value,
+	}
+}
+
+// logError logs msg with the phase, the name and attrs if a logger is customized.
+func logError(options *mapReduceOptions, msg string, phase Phase, attrs ...any) {
+	if options.logger == nil {
+		return
+	}
+
+	attrs = append(attrs, slog.String("phase", phase.String()))
+	if len(options.name) > 0 {
+		attrs = append(attrs, slog.String("name", options.name))
+	}
+	options.logger.ErrorContext(options.ctx, msg, attrs...)
+}
+
+// skipPanic returns the func to record the skipped mapper panics,
+// nil is returned if the panicking mappers are not skipped.
+func skipPanic(options *mapReduceOptions) func(r any) {
+	if options.panicPolicy != WorkerPanicSkip {
+		return nil
+	}
+
+	return func(r any) {
+		v := panicValue{
+			phase: PhaseMap,
+			value: r,
+		}
+		logError(options, "mapreduce panicked", v.phase, slog.Any("panic", v.value))
+		if options.onError != nil {
+			options.onError(newPanicError(options, v))
 		}
 	}
 }
 
+// noOutputError returns the error that reducer did not write any value.
+func noOutputError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		// the reducer output is dropped because of the ctx
+		return context.Cause(ctx)
+	}
+
+	return ErrReduceNoOutput
+}
+
 func newOptions() *mapReduceOptions {
 	return &mapReduceOptions{
-		ctx:     context.Background(),
-		workers: defaultWorkers,
+		ctx:        context.Background(),
+		cancel:     func() {},
+		workers:    defaultWorkers,
+		maxWorkers: defaultMaxWorkers,
+		bufferSize: -1,
+	}
+}
+
+// retry calls fn until it succeeds or the retries are exhausted, returns the last error.
+func retry(ctx context.Context, options *mapReduceOptions, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= options.retries; attempt++ {
+		if options.backoff != nil {
+			timer := time.NewTimer(options.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return err
+		}
+
+		err = fn()
+	}
+
+	return err
+}
+
+func withoutCtxMapper[T, U any](mapper MapperFunc[T, U]) MapperCtxFunc[T, U] {
+	return func(_ context.Context, item T, writer Writer[U], cancel func(error)) {
+		mapper(item, writer, cancel)
+	}
+}
+
+func withoutCtxReducer[U, V any](reducer ReducerFunc[U, V]) ReducerCtxFunc[U, V] {
+	return func(_ context.Context, pipe <-chan U, writer Writer[V], cancel func(error)) {
+		reducer(pipe, writer, cancel)
+	}
+}
+
+// WorkerValue returns the value returned by the func customized by WithWorkerInit for the worker running
+// the mapper with ctx, which is the ctx passed to the mappers in MapReduceCtx. nil is returned if not customized.
+func WorkerValue(ctx context.Context) any {
+	return ctx.Value(workerValueKey{})
+}
+
+// workerValueKey is the ctx key of the value returned by the func customized by WithWorkerInit.
+type workerValueKey struct{}
+
+// workerSet counts the workers customized by WithWorkerInit and WithWorkerCleanup,
+// the idle workers are reused before starting new ones.
+type workerSet struct {
+	lock sync.Mutex
+	// idle and created keep the values returned by the init of the workers
+	idle    []any
+	created []any
+}
+
+// take takes the value of an idle worker, or starts a new one with init.
+func (ws *workerSet) take(init func() any) any {
+	ws.lock.Lock()
+	if n := len(ws.idle); n > 0 {
+		value := ws.idle[n-1]
+		ws.idle = ws.idle[:n-1]
+		ws.lock.Unlock()
+		return value
+	}
+	ws.lock.Unlock()
+
+	// a panicking init doesn't start a worker, so it's not cleaned up
+	var value any
+	if init != nil {
+		value = init()
+	}
+	ws.lock.Lock()
+	ws.created = append(ws.created, value)
+	ws.lock.Unlock()
+	return value
+}
+
+// put puts the worker with value back to be idle.
+func (ws *workerSet) put(value any) {
+	ws.lock.Lock()
+	ws.idle = append(ws.idle, value)
+	ws.lock.Unlock()
+}
+
+// unwrapWeight returns the weight func of the wrapped elements, which weighs the original ones,
+// nil is returned if weight is nil.
+func unwrapWeight[W any](weight func(item any) int, unwrap func(item W) any) func(item any) int {
+	if weight == nil {
+		return nil
+	}
+
+	return func(item any) int {
+		return weight(unwrap(item.(W)))
 	}
 }
 
@@ -344,10 +2235,19 @@ func once(fn func(error)) func(error) {
 	}
 }
 
+// backpressure calls hook with true if a write is blocked longer than threshold, and with false after unblocked.
+// A nil hook means not reporting.
+type backpressure struct {
+	threshold time.Duration
+	hook      func(waiting bool)
+}
+
 type guardedWriter[T any] struct {
-	ctx     context.Context
-	channel chan<- T
-	done    <-chan struct{}
+	ctx      context.Context
+	channel  chan<- T
+	done     <-chan struct{}
+	pressure backpressure
+	guard    *closeGuard
 }
 
 func newGuardedWriter[T any](ctx context.Context, channel chan<- T, done <-chan struct{}) guardedWriter[T] {
@@ -359,23 +2259,170 @@ func newGuardedWriter[T any](ctx context.Context, channel chan<- T, done <-chan
 }
 
 func (gw guardedWriter[T]) Write(v T) {
+	gw.WriteOK(v)
+}
+
+func (gw guardedWriter[T]) WriteOK(v T) bool {
+	if gw.guard != nil {
+		// channel can't be closed while writing
+		gw.guard.lock.RLock()
+		defer gw.guard.lock.RUnlock()
+		if gw.guard.closed {
+			gw.guard.report(v)
+			return false
+		}
+	}
+
+	// check cancellation first, otherwise the send might win if channel is not full
 	select {
 	case <-gw.ctx.Done():
-		return
+		return false
 	case <-gw.done:
-		return
+		return false
 	default:
-		gw.channel <- v
+	}
+
+	if gw.pressure.hook != nil {
+		return gw.writeReporting(v)
+	}
+
+	select {
+	case <-gw.ctx.Done():
+		return false
+	case <-gw.done:
+		return false
+	case gw.channel <- v:
+		return true
 	}
 }
 
+// writeReporting writes v like WriteOK, and reports the backpressure if blocked longer than the threshold.
+func (gw guardedWriter[T]) writeReporting(v T) bool {
+	// no timer is needed if not blocked
+	select {
+	case gw.channel <- v:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(gw.pressure.threshold)
+	defer timer.Stop()
+
+	select {
+	case <-gw.ctx.Done():
+		return false
+	case <-gw.done:
+		return false
+	case gw.channel <- v:
+		return true
+	case <-timer.C:
+	}
+
+	gw.pressure.hook(true)
+	defer gw.pressure.hook(false)
+
+	select {
+	case <-gw.ctx.Done():
+		return false
+	case <-gw.done:
+		return false
+	case gw.channel <- v:
+		return true
+	}
+}
+
+// closeGuard detects the writes after the collector is closed, instead of panicking on sending to closed channel.
+type closeGuard struct {
+	lock    sync.RWMutex
+	closed  bool
+	options *mapReduceOptions
+}
+
+// newCloseGuard returns the closeGuard if WithCollectorClosedCheck is used, otherwise nil.
+func newCloseGuard(options *mapReduceOptions) *closeGuard {
+	if !options.closedCheck {
+		return nil
+	}
+
+	return &closeGuard{
+		options: options,
+	}
+}
+
+// close calls fn to close the collector after the in-progress writes finished.
+func (g *closeGuard) close(fn func()) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	fn()
+}
+
+// report logs the late write of v, and passes the error to the func customized by WithOnError.
+func (g *closeGuard) report(v any) {
+	err := fmt.Errorf("%w: %v", ErrWriteAfterClose, v)
+	logError(g.options, "mapreduce write after collector closed", PhaseMap, slog.Any("error", err))
+	if g.options.onError != nil {
+		g.options.onError(err)
+	}
+}
+
+// countingWriter counts the elements written successfully.
+type countingWriter[T any] struct {
+	writer  CheckedWriter[T]
+	counter *int64
+}
+
+func (cw countingWriter[T]) Write(v T) {
+	cw.WriteOK(v)
+}
+
+func (cw countingWriter[T]) WriteOK(v T) bool {
+	if !cw.writer.WriteOK(v) {
+		return false
+	}
+
+	atomic.AddInt64(cw.counter, 1)
+	return true
+}
+
+func (s *runStats) addItem() {
+	if s != nil {
+		atomic.AddInt64(&s.itemsIn, 1)
+	}
+}
+
+func (s *runStats) cancel() {
+	if s != nil {
+		atomic.StoreInt32(&s.cancelled, 1)
+	}
+}
+
+// snapshot returns the Stats with the current counters, it should be called after the processing.
+func (s *runStats) snapshot(duration time.Duration) Stats {
+	return Stats{
+		ItemsIn:   int(atomic.LoadInt64(&s.itemsIn)),
+		MapOut:    int(atomic.LoadInt64(&s.mapOut)),
+		Duration:  duration,
+		Cancelled: atomic.LoadInt32(&s.cancelled) == 1,
+	}
+}
+
+// panicValue is the recovered panic value in phase.
+type panicValue struct {
+	phase Phase
+	value any
+}
+
 type onceChan struct {
-	channel chan any
+	channel chan panicValue
 	wrote   int32
 }
 
-func (oc *onceChan) write(val any) {
+func (oc *onceChan) write(phase Phase, val any) {
 	if atomic.CompareAndSwapInt32(&oc.wrote, 0, 1) {
-		oc.channel <- val
+		oc.channel <- panicValue{
+			phase: phase,
+			value: val,
+		}
 	}
 }
@@ -3,9 +3,14 @@ package mapreduce
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -20,6 +25,105 @@ func init() {
 	log.SetOutput(ioutil.Discard)
 }
 
+// intRange generates 0 to n-1, it stops sending if the processing doesn't need more elements.
+func intRange(n int) GenerateFunc[int] {
+	return func(source chan<- int) {
+		quit := QuitChan(source)
+		for i := 0; i < n; i++ {
+			select {
+			case <-quit:
+				return
+			case source <- i:
+			}
+		}
+	}
+}
+
+func sumReducer(pipe <-chan int, writer Writer[int], cancel func(error)) {
+	var result int
+	for item := range pipe {
+		result += item
+	}
+	writer.Write(result)
+}
+
+func TestAny(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("second succeeds", func(t *testing.T) {
+		err := Any(func() error {
+			return errDummy
+		}, func() error {
+			return nil
+		}, func() error {
+			return errDummy
+		})
+		assert.Nil(t, err)
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		errOther := errors.New("other")
+		err := Any(func() error {
+			return errDummy
+		}, func() error {
+			return errOther
+		})
+		assert.ErrorIs(t, err, errDummy)
+		assert.ErrorIs(t, err, errOther)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		assert.Nil(t, Any())
+	})
+
+	t.Run("nil func", func(t *testing.T) {
+		assert.Equal(t, ErrNilFunc, Any(nil))
+	})
+}
+
+func TestAnyCtx(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("second succeeds", func(t *testing.T) {
+		var started sync.WaitGroup
+		started.Add(3)
+		var cancelled int32
+		wait := func(ctx context.Context) error {
+			started.Done()
+			select {
+			case <-ctx.Done():
+				atomic.AddInt32(&cancelled, 1)
+				return ctx.Err()
+			case <-time.After(time.Second * 5):
+				return errDummy
+			}
+		}
+		err := AnyCtx(context.Background(), wait, func(ctx context.Context) error {
+			started.Done()
+			// succeed after the others started, otherwise they might not be scheduled
+			started.Wait()
+			return nil
+		}, wait)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&cancelled) == 2
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*10, cancel)
+		stopped := make(chan struct{})
+		err := AnyCtx(ctx, func(ctx context.Context) error {
+			defer close(stopped)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		<-stopped
+	})
+}
+
 func TestFinish(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -66,7 +170,79 @@ func TestFinishErr(t *testing.T) {
 		return nil
 	})
 
-	assert.Equal(t, errDummy, err)
+	assert.ErrorIs(t, err, errDummy)
+}
+
+func TestFinishCtx(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("all", func(t *testing.T) {
+		var total uint32
+		err := FinishCtx(context.Background(), func(ctx context.Context) error {
+			atomic.AddUint32(&total, 2)
+			return nil
+		}, func(ctx context.Context) error {
+			atomic.AddUint32(&total, 3)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(5), atomic.LoadUint32(&total))
+	})
+
+	t.Run("first error", func(t *testing.T) {
+		started := make(chan struct{})
+		stopped := make(chan error, 1)
+		err := FinishCtx(context.Background(), func(ctx context.Context) error {
+			// fail after the other fn started, otherwise it might not be scheduled
+			<-started
+			return errDummy
+		}, func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				stopped <- context.Cause(ctx)
+				return ctx.Err()
+			case <-time.After(time.Second * 5):
+				stopped <- nil
+				return nil
+			}
+		})
+		assert.ErrorIs(t, err, errDummy)
+		assert.ErrorIs(t, <-stopped, errDummy)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*10, cancel)
+		stopped := make(chan struct{})
+		err := FinishCtx(ctx, func(ctx context.Context) error {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second * 5):
+				return nil
+			}
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		<-stopped
+	})
+}
+
+func TestFinishWithInnerNoOutput(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	err := Finish(func() error {
+		return nil
+	}, func() error {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			drain(pipe)
+		})
+		return err
+	})
+	assert.ErrorIs(t, err, ErrReduceNoOutput)
 }
 
 func TestFinishVoid(t *testing.T) {
@@ -84,6 +260,55 @@ func TestFinishVoid(t *testing.T) {
 	assert.Equal(t, uint32(10), atomic.LoadUint32(&total))
 }
 
+func TestMustFinish(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var total uint32
+	assert.NotPanics(t, func() {
+		MustFinish(func() error {
+			atomic.AddUint32(&total, 2)
+			return nil
+		}, func() error {
+			atomic.AddUint32(&total, 3)
+			return nil
+		})
+	})
+	assert.Equal(t, uint32(5), atomic.LoadUint32(&total))
+
+	defer func() {
+		err, ok := recover().(error)
+		assert.True(t, ok)
+		assert.ErrorIs(t, err, errDummy)
+	}()
+	MustFinish(func() error {
+		return errDummy
+	})
+	assert.Fail(t, "should panic")
+}
+
+func TestMustMapReduce(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("value", func(t *testing.T) {
+		val := MustMapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		defer func() {
+			err, ok := recover().(error)
+			assert.True(t, ok)
+			assert.ErrorIs(t, err, errDummy)
+		}()
+		MustMapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			cancel(errDummy)
+		}, sumReducer)
+		assert.Fail(t, "should panic")
+	})
+}
+
 func TestForEach(t *testing.T) {
 	const tasks = 1000
 
@@ -134,6 +359,201 @@ func TestForEach(t *testing.T) {
 	})
 }
 
+func TestCheckedWriter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var dropped, written int32
+	_, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int], cancel func(error)) {
+		if item == 1 {
+			cancel(errDummy)
+		}
+
+		w, ok := writer.(CheckedWriter[int])
+		if !assert.True(t, ok) {
+			return
+		}
+		if item == 1 {
+			// already cancelled, the write must be dropped
+			assert.False(t, w.WriteOK(item))
+		}
+		if w.WriteOK(item) {
+			atomic.AddInt32(&written, 1)
+		} else {
+			atomic.AddInt32(&dropped, 1)
+		}
+	}, sumReducer, WithSequential())
+	assert.ErrorIs(t, err, errDummy)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&written))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dropped))
+}
+
+func TestGuardedWriterUnblock(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("ctx", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		channel := make(chan int, 1)
+		channel <- 1
+		writer := newGuardedWriter(ctx, channel, make(chan struct{}))
+		written := make(chan bool)
+		go func() {
+			written <- writer.WriteOK(2)
+		}()
+
+		cancel()
+		select {
+		case ok := <-written:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("blocked write not unblocked after cancel")
+		}
+		assert.Len(t, channel, 1)
+	})
+
+	t.Run("done", func(t *testing.T) {
+		channel := make(chan int, 1)
+		channel <- 1
+		done := make(chan struct{})
+		writer := newGuardedWriter(context.Background(), channel, done)
+		written := make(chan bool)
+		go func() {
+			written <- writer.WriteOK(2)
+		}()
+
+		close(done)
+		select {
+		case ok := <-written:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("blocked write not unblocked after done")
+		}
+	})
+
+	t.Run("cancelled with room", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		channel := make(chan int, 10)
+		writer := newGuardedWriter(ctx, channel, make(chan struct{}))
+		for i := 0; i < 10; i++ {
+			writer.Write(i)
+		}
+		// cancellation always wins over the send
+		assert.Empty(t, channel)
+	})
+}
+
+func TestCountVoid(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name   string
+		count  int
+		opts   []Option
+		expect int
+	}{
+		{
+			name:   "default",
+			count:  100,
+			expect: 100,
+		},
+		{
+			name:   "single worker",
+			count:  100,
+			opts:   []Option{WithWorkers(1)},
+			expect: 100,
+		},
+		{
+			name:   "empty",
+			expect: 0,
+		},
+		{
+			name:   "max items",
+			count:  100,
+			opts:   []Option{WithMaxItems(10)},
+			expect: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, CountVoid(Repeat(1, test.count), test.opts...))
+		})
+	}
+}
+
+func TestForEachIndexed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 1000
+	var lock sync.Mutex
+	seen := make(map[int]int)
+	ForEachIndexed(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i * 2
+		}
+	}, func(index, item int) {
+		lock.Lock()
+		defer lock.Unlock()
+		seen[index]++
+		// the index is the position of the element in the order of generation
+		assert.Equal(t, index*2, item)
+	})
+
+	assert.Len(t, seen, tasks)
+	for i := 0; i < tasks; i++ {
+		assert.Equal(t, 1, seen[i])
+	}
+}
+
+func TestForEachErr(t *testing.T) {
+	const tasks = 1000
+
+	t.Run("all", func(t *testing.T) {
+		defer goleak.VerifyNone(t)
+
+		var count uint32
+		err := ForEachErr(func(source chan<- int) {
+			for i := 0; i < tasks; i++ {
+				source <- i
+			}
+		}, func(item int) error {
+			atomic.AddUint32(&count, 1)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, tasks, int(count))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		defer goleak.VerifyNone(t)
+
+		var count uint32
+		err := ForEachErr(intRange(tasks), func(item int) error {
+			atomic.AddUint32(&count, 1)
+			if item == tasks/10 {
+				return errDummy
+			}
+			return nil
+		}, WithWorkers(2))
+		assert.ErrorIs(t, err, errDummy)
+		assert.True(t, atomic.LoadUint32(&count) < tasks)
+	})
+
+	t.Run("context", func(t *testing.T) {
+		defer goleak.VerifyNone(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := ForEachErr(intRange(tasks), func(item int) error {
+			if item == tasks/10 {
+				cancel()
+			}
+			return nil
+		}, WithContext(ctx))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
 func TestGeneratePanic(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -154,11 +574,7 @@ func TestMapperPanic(t *testing.T) {
 	var run int32
 	t.Run("all", func(t *testing.T) {
 		assert.PanicsWithValue(t, "foo", func() {
-			_, _ = MapReduce(func(source chan<- int) {
-				for i := 0; i < tasks; i++ {
-					source <- i
-				}
-			}, func(item int, writer Writer[int], cancel func(error)) {
+			_, _ = MapReduce(intRange(tasks), func(item int, writer Writer[int], cancel func(error)) {
 				atomic.AddInt32(&run, 1)
 				panic("foo")
 			}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
@@ -236,13 +652,10 @@ func TestMapReduce(t *testing.T) {
 						writer.Write(result)
 					}
 				}
-				value, err := MapReduce(func(source chan<- int) {
-					for i := 1; i < 5; i++ {
-						source <- i
-					}
-				}, test.mapper, test.reducer, WithWorkers(runtime.NumCPU()))
+				value, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), test.mapper, test.reducer,
+					WithWorkers(runtime.NumCPU()))
 
-				assert.Equal(t, test.expectErr, err)
+				assert.ErrorIs(t, err, test.expectErr)
 				assert.Equal(t, test.expectValue, value)
 			})
 		}
@@ -275,8 +688,10 @@ func TestMapReduce(t *testing.T) {
 				}()
 
 				value, err := MapReduceChan(source, test.mapper, test.reducer, WithWorkers(-1))
-				assert.Equal(t, test.expectErr, err)
+				assert.ErrorIs(t, err, test.expectErr)
 				assert.Equal(t, test.expectValue, value)
+				// the source owned by the caller is not drained after cancelled
+				drain(source)
 			})
 		}
 	})
@@ -300,6 +715,48 @@ func TestMapReduceWithReduerWriteMoreThanOnce(t *testing.T) {
 	})
 }
 
+func TestWithReducerMultiWrite(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	reducer := func(pipe <-chan int, writer Writer[string], cancel func(error)) {
+		drain(pipe)
+		writer.Write("one")
+		writer.Write("two")
+		writer.Write("three")
+	}
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		assert.Panics(t, func() {
+			_, _ = MapReduce(FromSlice([]int{1, 2, 3}), mapper, reducer,
+				WithReducerMultiWrite(ReducerMultiWritePanic))
+		})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), mapper, reducer,
+			WithReducerMultiWrite(ReducerMultiWriteError))
+		assert.ErrorIs(t, err, ErrReducerMultiWrite)
+		assert.Empty(t, val)
+	})
+
+	t.Run("first", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), mapper, reducer,
+			WithReducerMultiWrite(ReducerMultiWriteFirst))
+		assert.Nil(t, err)
+		assert.Equal(t, "one", val)
+	})
+
+	t.Run("last", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), mapper, reducer,
+			WithReducerMultiWrite(ReducerMultiWriteLast))
+		assert.Nil(t, err)
+		assert.Equal(t, "three", val)
+	})
+}
+
 func TestMapReduceVoid(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -372,7 +829,7 @@ func TestMapReduceVoid(t *testing.T) {
 				}
 			}, test.mapper, test.reducer)
 
-			assert.Equal(t, test.expectErr, err)
+			assert.ErrorIs(t, err, test.expectErr)
 			if err == nil {
 				assert.Equal(t, test.expectValue, atomic.LoadUint32(&value))
 			}
@@ -380,198 +837,612 @@ func TestMapReduceVoid(t *testing.T) {
 	}
 }
 
-func TestMapReduceVoidWithDelay(t *testing.T) {
+func TestBatchMapReduce(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	var result []int
-	err := MapReduceVoid(func(source chan<- int) {
-		source <- 0
-		source <- 1
-	}, func(i int, writer Writer[int], cancel func(error)) {
-		if i == 0 {
-			time.Sleep(time.Millisecond * 50)
+	tests := []struct {
+		name   string
+		opts   []Option
+		expect []int
+	}{
+		{
+			name:   "remainder",
+			opts:   []Option{WithBatch(3)},
+			expect: []int{1, 3, 3, 3},
+		},
+		{
+			name:   "exact",
+			opts:   []Option{WithBatch(5)},
+			expect: []int{5, 5},
+		},
+		{
+			name:   "default",
+			expect: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sum int64
+			sizes, err := BatchMapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}), func(items []int,
+				writer Writer[int], cancel func(error)) {
+				for _, item := range items {
+					atomic.AddInt64(&sum, int64(item))
+				}
+				writer.Write(len(items))
+			}, func(pipe <-chan int, writer Writer[[]int], cancel func(error)) {
+				sizes := Collect(pipe)
+				sort.Ints(sizes)
+				writer.Write(sizes)
+			}, test.opts...)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, sizes)
+			assert.Equal(t, int64(55), sum)
+		})
+	}
+}
+
+func TestMapReduceWithProgress(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 100
+	val, err := MapReduceWithProgress(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
 		}
-		writer.Write(i)
-	}, func(pipe <-chan int, cancel func(error)) {
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}, func(pipe <-chan int, writer Writer[int], cancel func(error), progress func() (int, int)) {
+		var sum, count int
 		for item := range pipe {
-			i := item
-			result = append(result, i)
+			sum += item
+			count++
+			produced, consumed := progress()
+			assert.LessOrEqual(t, consumed, count)
+			assert.LessOrEqual(t, consumed, produced)
+			assert.LessOrEqual(t, produced, tasks)
 		}
+
+		produced, consumed := progress()
+		assert.Equal(t, tasks, produced)
+		assert.Equal(t, tasks, consumed)
+		writer.Write(sum)
 	})
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(result))
-	assert.Equal(t, 1, result[0])
-	assert.Equal(t, 0, result[1])
+	assert.Equal(t, tasks*(tasks-1)/2, val)
 }
 
-func TestMapReducePanic(t *testing.T) {
+func TestMapReduceWithErrors(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	assert.Panics(t, func() {
-		_, _ = MapReduce(func(source chan<- int) {
-			source <- 0
-			source <- 1
-		}, func(i int, writer Writer[int], cancel func(error)) {
-			writer.Write(i)
-		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
-			for range pipe {
-				panic("panic")
+	t.Run("item errors", func(t *testing.T) {
+		val, errs, err := MapReduceWithErrors(FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int) (int, error) {
+			if item%2 == 0 {
+				return 0, fmt.Errorf("bad %d: %w", item, errDummy)
 			}
-		})
+			return item, nil
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 9, val)
+		var messages []string
+		for e := range errs {
+			assert.ErrorIs(t, e, errDummy)
+			messages = append(messages, e.Error())
+		}
+		sort.Strings(messages)
+		assert.Equal(t, []string{"bad 2: dummy", "bad 4: dummy", "bad 6: dummy"}, messages)
 	})
-}
-
-func TestMapReducePanicOnce(t *testing.T) {
-	defer goleak.VerifyNone(t)
 
-	assert.Panics(t, func() {
-		_, _ = MapReduce(func(source chan<- int) {
-			for i := 0; i < 100; i++ {
-				source <- i
-			}
-		}, func(i int, writer Writer[int], cancel func(error)) {
-			if i == 0 {
-				panic("foo")
-			}
-			writer.Write(i)
+	t.Run("fatal error", func(t *testing.T) {
+		_, errs, err := MapReduceWithErrors(FromSlice([]int{1, 2, 3}), func(item int) (int, error) {
+			return item, nil
 		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
-			for range pipe {
-				panic("bar")
-			}
+			cancel(errDummy)
 		})
+		assert.ErrorIs(t, err, errDummy)
+		for range errs {
+			assert.Fail(t, "no item error expected")
+		}
+	})
+
+	t.Run("nil func", func(t *testing.T) {
+		_, errs, err := MapReduceWithErrors[int, int, int](nil, nil, nil)
+		assert.Equal(t, ErrNilFunc, err)
+		_, ok := <-errs
+		assert.False(t, ok)
 	})
 }
 
-func TestMapReducePanicBothMapperAndReducer(t *testing.T) {
+func TestWithGlobalLimit(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	assert.Panics(t, func() {
-		_, _ = MapReduce(func(source chan<- int) {
-			source <- 0
-			source <- 1
-		}, func(item int, writer Writer[int], cancel func(error)) {
-			panic("foo")
-		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
-			panic("bar")
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{name: "single token", limit: 1},
+		{name: "shared tokens", limit: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var running, peak int64
+			enter := func() {
+				n := atomic.AddInt64(&running, 1)
+				for {
+					old := atomic.LoadInt64(&peak)
+					if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+						break
+					}
+				}
+			}
+			leave := func() {
+				atomic.AddInt64(&running, -1)
+			}
+
+			ctx := WithGlobalLimit(context.Background(), test.limit)
+			val, err := MapReduceCtx(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8}),
+				func(ctx context.Context, item int, writer Writer[int], cancel func(error)) {
+					enter()
+					// the calling mapper waits for the nested processing, which runs on its token
+					leave()
+					sum, err := MapReduceCtx(FromSlice([]int{1, 2, 3, 4}),
+						func(ctx context.Context, inner int, writer Writer[int], cancel func(error)) {
+							enter()
+							time.Sleep(time.Millisecond)
+							leave()
+							writer.Write(item * inner)
+						}, func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+							sumReducer(pipe, writer, cancel)
+						}, WithContext(ctx))
+					if err != nil {
+						cancel(err)
+						return
+					}
+					// the token is given up while writing
+					writer.Write(sum)
+				}, func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+					sumReducer(pipe, writer, cancel)
+				}, WithContext(ctx))
+			assert.Nil(t, err)
+			assert.Equal(t, 36*10, val)
+			assert.LessOrEqual(t, atomic.LoadInt64(&peak), int64(test.limit))
 		})
-	})
+	}
 }
 
-func TestMapReduceVoidCancel(t *testing.T) {
+func TestWithGlobalLimitNestedInReducer(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	var result []int
-	err := MapReduceVoid(func(source chan<- int) {
-		source <- 0
-		source <- 1
-	}, func(i int, writer Writer[int], cancel func(error)) {
-		if i == 1 {
-			cancel(errors.New("anything"))
-		}
-		writer.Write(i)
-	}, func(pipe <-chan int, cancel func(error)) {
-		for item := range pipe {
-			i := item
-			result = append(result, i)
+	ctx := WithGlobalLimit(context.Background(), 2)
+	result := make(chan int, 1)
+	errs := make(chan error, 1)
+	go func() {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			for i := 0; i < 10; i++ {
+				writer.Write(item)
+			}
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			var sum int
+			for item := range pipe {
+				// the mappers blocked on writing must not starve the nested processing
+				v, err := MapReduce(FromSlice([]int{item}), func(item int, writer Writer[int], cancel func(error)) {
+					writer.Write(item)
+				}, SumReducer[int], WithContext(ctx))
+				if err != nil {
+					cancel(err)
+					return
+				}
+				sum += v
+			}
+			writer.Write(sum)
+		}, WithContext(ctx), WithBufferSize(1))
+		result <- val
+		errs <- err
+	}()
+
+	select {
+	case val := <-result:
+		assert.Nil(t, <-errs)
+		assert.Equal(t, 100, val)
+	case <-time.After(time.Second * 5):
+		t.Fatal("deadlocked on the global limit")
+	}
+}
+
+func TestMapReduceSlice(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("all", func(t *testing.T) {
+		result, err := MapReduceSlice(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []int{1, 4, 9, 16}, result)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		result, err := MapReduceSlice(FromSlice([]int{}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		})
+		assert.Nil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, err := MapReduceSlice(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 3 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		})
+		assert.ErrorIs(t, err, errDummy)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		result, err := MapReduceSlice(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}), func(item int,
+			writer Writer[int], cancel func(error)) {
+			if item == 6 {
+				cancel(errDummy)
+				return
+			}
+			writer.Write(item)
+		}, WithSequential())
+		assert.ErrorIs(t, err, errDummy)
+		// the collector is buffered with one element, so at least 4 elements are received,
+		// but the last received one might not be collected when cancelled
+		assert.GreaterOrEqual(t, len(result), 3)
+		for _, item := range result {
+			assert.Less(t, item, 6)
 		}
 	})
-	assert.NotNil(t, err)
-	assert.Equal(t, "anything", err.Error())
+
+	t.Run("panic", func(t *testing.T) {
+		assert.PanicsWithValue(t, "foo", func() {
+			_, _ = MapReduceSlice(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+				panic("foo")
+			})
+		})
+	})
 }
 
-func TestMapReduceVoidCancelWithRemains(t *testing.T) {
+func TestMapTakeN(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	var done int32
-	var result []int
-	err := MapReduceVoid(func(source chan<- int) {
-		for i := 0; i < defaultWorkers*2; i++ {
-			source <- i
-		}
-		atomic.AddInt32(&done, 1)
-	}, func(i int, writer Writer[int], cancel func(error)) {
-		if i == defaultWorkers/2 {
-			cancel(errors.New("anything"))
-		}
-		writer.Write(i)
-	}, func(pipe <-chan int, cancel func(error)) {
-		for item := range pipe {
-			result = append(result, item)
-		}
+	t.Run("first n", func(t *testing.T) {
+		const workers = 4
+		var mapped int32
+		result, err := MapTakeN(RepeatForever(1), func(item int, writer Writer[int], cancel func(error)) {
+			atomic.AddInt32(&mapped, 1)
+			writer.Write(item)
+		}, 5, WithWorkers(workers))
+		assert.Nil(t, err)
+		assert.Equal(t, []int{1, 1, 1, 1, 1}, result)
+		// the endless generator is stopped, only the buffered, in-flight and scheduling elements are mapped after n collected
+		assert.LessOrEqual(t, atomic.LoadInt32(&mapped), int32(5+2*workers+1))
+	})
+
+	t.Run("fewer than n", func(t *testing.T) {
+		result, err := MapTakeN(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, 5)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []int{1, 2, 3}, result)
+	})
+
+	t.Run("non-positive n", func(t *testing.T) {
+		result, err := MapTakeN(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, 0)
+		assert.Nil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, err := MapTakeN(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 3 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, 10)
+		assert.ErrorIs(t, err, errDummy)
 	})
-	assert.NotNil(t, err)
-	assert.Equal(t, "anything", err.Error())
-	assert.Equal(t, int32(1), done)
 }
 
-func TestMapReduceWithoutReducerWrite(t *testing.T) {
+func TestMapReduceWithBufferSize(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	uids := []int{1, 2, 3}
-	res, err := MapReduce(func(source chan<- int) {
-		for _, uid := range uids {
-			source <- uid
+	const tasks = 10
+	var mapped int32
+	val, err := MapReduce(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
 		}
 	}, func(item int, writer Writer[int], cancel func(error)) {
 		writer.Write(item)
+		atomic.AddInt32(&mapped, 1)
 	}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
-		drain(pipe)
-		// not calling writer.Write(...), should not panic
+		// all mappers complete before the reducer starts draining
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&mapped) == tasks
+		}, time.Second, time.Millisecond)
+		sumReducer(pipe, writer, cancel)
+	}, WithWorkers(1), WithBufferSize(tasks))
+	assert.Nil(t, err)
+	assert.Equal(t, 45, val)
+}
+
+func TestWithBufferSize(t *testing.T) {
+	assert.Equal(t, defaultWorkers, buildOptions().bufferSize)
+	assert.Equal(t, 3, buildOptions(WithWorkers(3)).bufferSize)
+	assert.Equal(t, 3, buildOptions(WithWorkers(3), WithBufferSize(-1)).bufferSize)
+	assert.Equal(t, 0, buildOptions(WithBufferSize(0)).bufferSize)
+	assert.Equal(t, 100, buildOptions(WithWorkers(3), WithBufferSize(100)).bufferSize)
+}
+
+func TestWithMaxWorkers(t *testing.T) {
+	assert.Equal(t, defaultMaxWorkers, buildOptions(WithWorkers(defaultMaxWorkers*2)).workers)
+	assert.Equal(t, 8, buildOptions(WithMaxWorkers(8), WithWorkers(100)).workers)
+	assert.Equal(t, 3, buildOptions(WithMaxWorkers(8), WithWorkers(3)).workers)
+	assert.Equal(t, 8, buildOptions(WithMaxWorkers(8), WithWorkersFunc(func() int {
+		return 100
+	})).workers)
+	assert.Equal(t, defaultMaxWorkers, buildOptions(WithMaxWorkers(-1), WithWorkers(defaultMaxWorkers*2)).workers)
+
+	handler := new(captureHandler)
+	buildOptions(WithLogger(slog.New(handler)), WithMaxWorkers(8), WithWorkers(100))
+	if assert.Len(t, handler.records, 1) {
+		assert.Equal(t, slog.LevelWarn, handler.records[0].Level)
+		assert.Equal(t, int64(100), handler.attrs(0)["workers"])
+		assert.Equal(t, int64(8), handler.attrs(0)["max"])
+	}
+}
+
+func TestResolveOptions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		expect Options
+	}{
+		{
+			name: "defaults",
+			expect: Options{
+				Workers:    defaultWorkers,
+				MaxWorkers: defaultMaxWorkers,
+				BufferSize: defaultWorkers,
+			},
+		},
+		{
+			name: "clamped",
+			opts: []Option{WithName("clamped"), WithMaxWorkers(8), WithWorkers(100), WithBufferSize(3)},
+			expect: Options{
+				Name:       "clamped",
+				Workers:    8,
+				MaxWorkers: 8,
+				BufferSize: 3,
+			},
+		},
+		{
+			name: "too few workers",
+			opts: []Option{WithWorkers(-1)},
+			expect: Options{
+				Workers:    minWorkers,
+				MaxWorkers: defaultMaxWorkers,
+				BufferSize: minWorkers,
+			},
+		},
+		{
+			name: "sequential",
+			opts: []Option{WithWorkers(10), WithSequential(), WithSourceBuffer(5)},
+			expect: Options{
+				Workers:      1,
+				MaxWorkers:   defaultMaxWorkers,
+				BufferSize:   1,
+				SourceBuffer: 5,
+				Sequential:   true,
+			},
+		},
+		{
+			name: "context",
+			opts: []Option{WithContext(ctx)},
+			expect: Options{
+				Workers:     defaultWorkers,
+				MaxWorkers:  defaultMaxWorkers,
+				BufferSize:  defaultWorkers,
+				Cancellable: true,
+			},
+		},
+		{
+			name: "timeout",
+			opts: []Option{WithTimeout(time.Second)},
+			expect: Options{
+				Workers:     defaultWorkers,
+				MaxWorkers:  defaultMaxWorkers,
+				BufferSize:  defaultWorkers,
+				Timeout:     time.Second,
+				Cancellable: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, ResolveOptions(test.opts...))
+		})
+	}
+}
+
+func TestWithBackpressureHook(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("slow reducer", func(t *testing.T) {
+		var waiting, unblocked int32
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			var sum int
+			for item := range pipe {
+				time.Sleep(time.Millisecond * 10)
+				sum += item
+			}
+			writer.Write(sum)
+		}, WithWorkers(4), WithBufferSize(1), WithBackpressureHook(time.Millisecond, func(w bool) {
+			if w {
+				atomic.AddInt32(&waiting, 1)
+			} else {
+				atomic.AddInt32(&unblocked, 1)
+			}
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, 36, val)
+		assert.True(t, atomic.LoadInt32(&waiting) > 0)
+		assert.Equal(t, atomic.LoadInt32(&waiting), atomic.LoadInt32(&unblocked))
+	})
+
+	t.Run("fast reducer", func(t *testing.T) {
+		var reported int32
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithBackpressureHook(time.Second, func(w bool) {
+			atomic.AddInt32(&reported, 1)
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, 10, val)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&reported))
 	})
-	assert.Equal(t, ErrReduceNoOutput, err)
-	assert.Equal(t, 0, res)
 }
 
-func TestMapReduceVoidPanicInReducer(t *testing.T) {
+func TestWithCollectorClosedCheck(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	const message = "foo"
-	assert.Panics(t, func() {
-		var done int32
-		_ = MapReduceVoid(func(source chan<- int) {
-			for i := 0; i < defaultWorkers*2; i++ {
-				source <- i
+	var late sync.WaitGroup
+	errs := make(chan error, 1)
+	val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+		if item == 2 {
+			late.Add(1)
+			go func() {
+				defer late.Done()
+				// written after all the mappers returned
+				time.Sleep(time.Millisecond * 20)
+				writer.Write(42)
+			}()
+		}
+	}, sumReducer, WithCollectorClosedCheck(), WithOnError(func(err error) {
+		errs <- err
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, val)
+
+	late.Wait()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrWriteAfterClose)
+		assert.Contains(t, err.Error(), "42")
+	default:
+		assert.Fail(t, "late write not reported")
+	}
+}
+
+func TestMapReduceWithAllErrors(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("errors", func(t *testing.T) {
+		errs := []error{errors.New("foo"), errors.New("bar"), errors.New("baz")}
+		var mapped int32
+		val, err := MapReduce(FromSlice([]int{0, 1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			atomic.AddInt32(&mapped, 1)
+			if item%2 == 0 {
+				cancel(errs[item/2])
+				return
 			}
-			atomic.AddInt32(&done, 1)
-		}, func(i int, writer Writer[int], cancel func(error)) {
-			writer.Write(i)
-		}, func(pipe <-chan int, cancel func(error)) {
-			panic(message)
-		}, WithWorkers(1))
+			writer.Write(item)
+		}, sumReducer, WithAllErrors())
+		assert.Equal(t, 0, val)
+		assert.Equal(t, int32(6), atomic.LoadInt32(&mapped))
+		for _, e := range errs {
+			assert.ErrorIs(t, err, e)
+		}
+		assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), len(errs))
+	})
+
+	t.Run("cancel with nil", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2}), func(item int, writer Writer[int], cancel func(error)) {
+			cancel(nil)
+		}, sumReducer, WithAllErrors())
+		assert.ErrorIs(t, err, ErrCancelWithNil)
+	})
+
+	t.Run("no error", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithAllErrors())
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
 	})
 }
 
-func TestForEachWithContext(t *testing.T) {
+func TestWithWorkersFunc(t *testing.T) {
+	items := make([]int, 5)
+	assert.Equal(t, len(items), buildOptions(WithWorkersFunc(func() int {
+		return len(items)
+	})).workers)
+	assert.Equal(t, minWorkers, buildOptions(WithWorkersFunc(func() int {
+		return 0
+	})).workers)
+	assert.Equal(t, 3, buildOptions(WithWorkersFunc(func() int {
+		return 10
+	}), WithWorkers(3)).workers)
+	assert.Equal(t, 10, buildOptions(WithWorkers(3), WithWorkersFunc(func() int {
+		return 10
+	})).workers)
+	assert.Equal(t, 10, buildOptions(WithWorkersFunc(func() int {
+		return 10
+	})).bufferSize)
+}
+
+func TestWithSequential(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	var done int32
-	ctx, cancel := context.WithCancel(context.Background())
-	ForEach(func(source chan<- int) {
-		for i := 0; i < defaultWorkers*2; i++ {
+	const tasks = 100
+	var running int32
+	val, err := MapReduceSlice(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
 			source <- i
 		}
-		atomic.AddInt32(&done, 1)
-	}, func(i int) {
-		if i == defaultWorkers/2 {
-			cancel()
-		}
-	}, WithContext(ctx))
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		assert.Equal(t, int32(1), atomic.AddInt32(&running, 1))
+		// later items finish faster, but the order is kept
+		time.Sleep(time.Microsecond * time.Duration(tasks-item))
+		writer.Write(item)
+		atomic.AddInt32(&running, -1)
+	}, WithSequential(), WithWorkers(10))
+	assert.Nil(t, err)
+	expect := make([]int, tasks)
+	for i := range expect {
+		expect[i] = i
+	}
+	assert.Equal(t, expect, val)
 }
 
-func TestMapReduceWithContext(t *testing.T) {
+func TestMapReduceVoidWithDelay(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	var done int32
 	var result []int
-	ctx, cancel := context.WithCancel(context.Background())
 	err := MapReduceVoid(func(source chan<- int) {
-		for i := 0; i < defaultWorkers*2; i++ {
-			source <- i
-		}
-		atomic.AddInt32(&done, 1)
-	}, func(i int, writer Writer[int], c func(error)) {
-		if i == defaultWorkers/2 {
-			cancel()
+		source <- 0
+		source <- 1
+	}, func(i int, writer Writer[int], cancel func(error)) {
+		if i == 0 {
+			time.Sleep(time.Millisecond * 50)
 		}
 		writer.Write(i)
 	}, func(pipe <-chan int, cancel func(error)) {
@@ -579,9 +1450,2053 @@ func TestMapReduceWithContext(t *testing.T) {
 			i := item
 			result = append(result, i)
 		}
-	}, WithContext(ctx))
-	assert.NotNil(t, err)
-	assert.Equal(t, context.DeadlineExceeded, err)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, 1, result[0])
+	assert.Equal(t, 0, result[1])
+}
+
+func TestNilFunc(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	generate := FromSlice([]int{1, 2, 3})
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}
+	source := make(chan int)
+	close(source)
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{
+			name: "nil generate",
+			fn: func() error {
+				_, err := MapReduce(nil, mapper, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil mapper",
+			fn: func() error {
+				_, err := MapReduce(generate, nil, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil reducer",
+			fn: func() error {
+				_, err := MapReduce[int, int, int](generate, mapper, nil)
+				return err
+			},
+		},
+		{
+			name: "nil reducer with progress",
+			fn: func() error {
+				_, err := MapReduceWithProgress[int, int, int](generate, mapper, nil)
+				return err
+			},
+		},
+		{
+			name: "nil generate with error",
+			fn: func() error {
+				_, err := MapReduceGen(nil, mapper, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil source",
+			fn: func() error {
+				_, err := MapReduceChan(nil, mapper, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil void reducer",
+			fn: func() error {
+				return MapReduceVoid(generate, mapper, nil)
+			},
+		},
+		{
+			name: "nil void reducer with source",
+			fn: func() error {
+				return MapReduceVoidWithSource(source, mapper, nil)
+			},
+		},
+		{
+			name: "nil batch mapper",
+			fn: func() error {
+				_, err := BatchMapReduce[int, int, int](generate, nil, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil mapper to take",
+			fn: func() error {
+				_, err := MapTakeN[int, int](generate, nil, 1)
+				return err
+			},
+		},
+		{
+			name: "nil ctx mapper",
+			fn: func() error {
+				_, err := MapReduceCtx[int, int, int](generate, nil, nil)
+				return err
+			},
+		},
+		{
+			name: "nil err mapper",
+			fn: func() error {
+				_, err := MapReduceErr[int, int, int](generate, nil, sumReducer)
+				return err
+			},
+		},
+		{
+			name: "nil stats reducer",
+			fn: func() error {
+				_, _, err := MapReduceWithStats[int, int, int](generate, mapper, nil)
+				return err
+			},
+		},
+		{
+			name: "nil ForEachErr fn",
+			fn: func() error {
+				return ForEachErr(generate, nil)
+			},
+		},
+		{
+			name: "nil Finish fn",
+			fn: func() error {
+				return Finish(func() error {
+					return nil
+				}, nil)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, ErrNilFunc, test.fn())
+		})
+	}
+
+	t.Run("panics", func(t *testing.T) {
+		assert.PanicsWithValue(t, ErrNilFunc, func() {
+			ForEach[int](nil, func(item int) {})
+		})
+		assert.PanicsWithValue(t, ErrNilFunc, func() {
+			ForEachIndexed(generate, nil)
+		})
+		assert.PanicsWithValue(t, ErrNilFunc, func() {
+			FinishVoid(nil)
+		})
+	})
+}
+
+func TestWithProgressChan(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 100
+	generate := func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
+		}
+	}
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		progress := make(chan int, tasks)
+		err := MapReduceVoid(generate, mapper, func(pipe <-chan int, cancel func(error)) {
+			drain(pipe)
+		}, WithProgressChan(progress))
+		assert.Nil(t, err)
+		// the concurrent mappers might send the counts out of order
+		var received, last int
+		for len(progress) > 0 {
+			last = max(last, <-progress)
+			received++
+		}
+		assert.Equal(t, tasks, received)
+		assert.Equal(t, tasks, last)
+	})
+
+	t.Run("no receiver", func(t *testing.T) {
+		// the updates are dropped instead of stalling the processing
+		progress := make(chan int)
+		err := MapReduceVoid(generate, mapper, func(pipe <-chan int, cancel func(error)) {
+			drain(pipe)
+		}, WithProgressChan(progress))
+		assert.Nil(t, err)
+	})
+}
+
+func TestMapReduceVoidWithSource(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("sum", func(t *testing.T) {
+		source := make(chan int, 10)
+		for i := 1; i <= 10; i++ {
+			source <- i
+		}
+		close(source)
+
+		var sum int
+		err := MapReduceVoidWithSource(source, func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * item)
+		}, func(pipe <-chan int, cancel func(error)) {
+			for item := range pipe {
+				sum += item
+			}
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 385, sum)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		source := make(chan int, 10)
+		for i := 1; i <= 10; i++ {
+			source <- i
+		}
+		close(source)
+
+		err := MapReduceVoidWithSource(source, func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, cancel func(error)) {
+			for range pipe {
+				cancel(errDummy)
+			}
+		})
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestMapReducePanic(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	assert.Panics(t, func() {
+		_, _ = MapReduce(func(source chan<- int) {
+			source <- 0
+			source <- 1
+		}, func(i int, writer Writer[int], cancel func(error)) {
+			writer.Write(i)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for range pipe {
+				panic("panic")
+			}
+		})
+	})
+}
+
+func TestMapReducePanicOnce(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	assert.Panics(t, func() {
+		_, _ = MapReduce(intRange(100), func(i int, writer Writer[int], cancel func(error)) {
+			if i == 0 {
+				panic("foo")
+			}
+			writer.Write(i)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for range pipe {
+				panic("bar")
+			}
+		})
+	})
+}
+
+func TestMapReducePanicBothMapperAndReducer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	assert.Panics(t, func() {
+		_, _ = MapReduce(func(source chan<- int) {
+			source <- 0
+			source <- 1
+		}, func(item int, writer Writer[int], cancel func(error)) {
+			panic("foo")
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			panic("bar")
+		})
+	})
+}
+
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+func TestMapReduceWithPanicHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	handler := func(recovered any) error {
+		return &panicError{
+			value: recovered,
+			stack: debug.Stack(),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		phase    Phase
+		generate GenerateFunc[int]
+		mapper   MapperFunc[int, int]
+		reducer  ReducerFunc[int, int]
+	}{
+		{
+			name:  "generate",
+			phase: PhaseGenerate,
+			generate: func(source chan<- int) {
+				source <- 1
+				panic("foo")
+			},
+		},
+		{
+			name:  "mapper",
+			phase: PhaseMap,
+			mapper: func(item int, writer Writer[int], cancel func(error)) {
+				if item == 2 {
+					panic("foo")
+				}
+				writer.Write(item)
+			},
+		},
+		{
+			name:  "reducer",
+			phase: PhaseReduce,
+			reducer: func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+				for range pipe {
+					panic("foo")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.generate == nil {
+				test.generate = FromSlice([]int{1, 2, 3})
+			}
+			if test.mapper == nil {
+				test.mapper = func(item int, writer Writer[int], cancel func(error)) {
+					writer.Write(item)
+				}
+			}
+			if test.reducer == nil {
+				test.reducer = sumReducer
+			}
+
+			val, err := MapReduce(test.generate, test.mapper, test.reducer, WithPanicHandler(handler))
+			assert.Equal(t, 0, val)
+			var pe *panicError
+			if assert.True(t, errors.As(err, &pe)) {
+				assert.Equal(t, "foo", pe.value)
+				assert.NotEmpty(t, pe.stack)
+			}
+			var mre *MapReduceError
+			if assert.True(t, errors.As(err, &mre)) {
+				assert.Equal(t, test.phase, mre.Phase)
+				assert.Equal(t, "foo", mre.PanicValue)
+			}
+		})
+	}
+}
+
+func TestWithErrorFilter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errNotFound := errors.New("not found")
+	filter := WithErrorFilter(func(err error) bool {
+		return !errors.Is(err, errNotFound)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item%2 == 0 {
+				cancel(errNotFound)
+				return
+			}
+			writer.Write(item)
+		}, sumReducer, filter)
+		assert.Nil(t, err)
+		assert.Equal(t, 9, val)
+	})
+
+	t.Run("not filtered", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 3 {
+				cancel(errDummy)
+				return
+			}
+			writer.Write(item)
+		}, sumReducer, filter)
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestWithWorkerPanicPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		if item == 3 {
+			panic("poison")
+		}
+		writer.Write(item)
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		var skipped atomic.Value
+		val, err := MapReduceSlice(FromSlice([]int{1, 2, 3, 4, 5}), mapper,
+			WithWorkerPanicPolicy(WorkerPanicSkip), WithOnError(func(err error) {
+				skipped.Store(err)
+			}))
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []int{1, 2, 4, 5}, val)
+		var mre *MapReduceError
+		if assert.True(t, errors.As(skipped.Load().(error), &mre)) {
+			assert.Equal(t, PhaseMap, mre.Phase)
+			assert.Equal(t, "poison", mre.PanicValue)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		assert.PanicsWithValue(t, "poison", func() {
+			_, _ = MapReduceSlice(FromSlice([]int{1, 2, 3, 4, 5}), mapper, WithWorkerPanicPolicy(WorkerPanicAbort))
+		})
+	})
+}
+
+func TestCancelWithErrStop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("reducer", func(t *testing.T) {
+		var mapped int32
+		val, err := MapReduce(intRange(1000), func(item int, writer Writer[int], cancel func(error)) {
+			atomic.AddInt32(&mapped, 1)
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for item := range pipe {
+				if item == 10 {
+					// found the target
+					writer.Write(item)
+					cancel(ErrStop)
+					return
+				}
+			}
+		}, WithWorkers(1))
+		assert.Nil(t, err)
+		assert.Equal(t, 10, val)
+		assert.Less(t, atomic.LoadInt32(&mapped), int32(1000))
+	})
+
+	t.Run("mapper", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 3 {
+				cancel(ErrStop)
+				return
+			}
+			writer.Write(item)
+		}, sumReducer, WithSequential())
+		assert.Nil(t, err)
+		assert.Equal(t, 3, val)
+	})
+}
+
+func TestWithOnError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var calls int32
+	var received atomic.Value
+	_, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8}), func(item int, writer Writer[int],
+		cancel func(error)) {
+		cancel(errDummy)
+	}, sumReducer, WithWorkers(8), WithOnError(func(err error) {
+		atomic.AddInt32(&calls, 1)
+		received.Store(err)
+	}))
+	assert.ErrorIs(t, err, errDummy)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, err, received.Load())
+}
+
+func TestWithDrainPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	run := func(policy DrainPolicy) (int32, int32, error) {
+		var completed, received int32
+		_, err := MapReduce(intRange(100), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 0 {
+				// let the other mappers be scheduled before cancelling
+				time.Sleep(time.Millisecond * 5)
+				cancel(errDummy)
+				return
+			}
+
+			time.Sleep(time.Millisecond * 20)
+			atomic.AddInt32(&completed, 1)
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for range pipe {
+				atomic.AddInt32(&received, 1)
+			}
+			writer.Write(0)
+		}, WithWorkers(4), WithDrainPolicy(policy))
+		return atomic.LoadInt32(&completed), atomic.LoadInt32(&received), err
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		completed, received, err := run(DrainPolicyAbort)
+		assert.ErrorIs(t, err, errDummy)
+		assert.Equal(t, int32(0), completed)
+		assert.Equal(t, int32(0), received)
+	})
+
+	t.Run("graceful", func(t *testing.T) {
+		completed, received, err := run(DrainPolicyGraceful)
+		assert.ErrorIs(t, err, errDummy)
+		assert.True(t, completed > 0)
+		assert.True(t, completed < 10)
+		assert.Equal(t, completed, received)
+	})
+
+	t.Run("graceful with timeout", func(t *testing.T) {
+		// the timeout aborts the processing after it's cancelled gracefully
+		started := make(chan struct{})
+		_, err := MapReduce(FromSlice([]int{0, 1}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 0 {
+				<-started
+				cancel(errDummy)
+				return
+			}
+
+			close(started)
+			time.Sleep(time.Millisecond * 100)
+			writer.Write(item)
+		}, sumReducer, WithWorkers(2), WithDrainPolicy(DrainPolicyGraceful), WithTimeout(time.Millisecond*20))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestWithSourceBuffer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const buffer = 5
+	var generated int32
+	block := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ForEach(func(source chan<- int) {
+			for i := 0; i < 100; i++ {
+				source <- i
+				atomic.AddInt32(&generated, 1)
+			}
+		}, func(item int) {
+			<-block
+		}, WithWorkers(1), WithSourceBuffer(buffer))
+	}()
+
+	// one element is taken by the blocked mapper, the others are kept in buffer
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, int32(buffer+1), atomic.LoadInt32(&generated))
+	close(block)
+	<-done
+	assert.Equal(t, int32(100), atomic.LoadInt32(&generated))
+}
+
+func TestWithStartStopHook(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("success", func(t *testing.T) {
+		var started, stopped int32
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			assert.Equal(t, int32(1), atomic.LoadInt32(&started))
+			writer.Write(item)
+		}, sumReducer, WithStartHook(func() {
+			atomic.AddInt32(&started, 1)
+		}), WithStopHook(func(err error) {
+			assert.Nil(t, err)
+			atomic.AddInt32(&stopped, 1)
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+		assert.Equal(t, int32(1), started)
+		assert.Equal(t, int32(1), stopped)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var stopErr error
+		var stopped int32
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			cancel(errDummy)
+		}, sumReducer, WithStopHook(func(err error) {
+			stopErr = err
+			atomic.AddInt32(&stopped, 1)
+		}))
+		assert.ErrorIs(t, err, errDummy)
+		assert.Equal(t, err, stopErr)
+		assert.Equal(t, int32(1), stopped)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		var stopped int32
+		assert.Panics(t, func() {
+			_, _ = MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+				panic("foo")
+			}, sumReducer, WithStopHook(func(err error) {
+				atomic.AddInt32(&stopped, 1)
+			}))
+		})
+		assert.Equal(t, int32(1), stopped)
+	})
+}
+
+type captureHandler struct {
+	lock    sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *captureHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *captureHandler) attrs(i int) map[string]any {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	attrs := make(map[string]any)
+	h.records[i].Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value.Any()
+		return true
+	})
+	return attrs
+}
+
+func TestWithLogger(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("panic", func(t *testing.T) {
+		handler := new(captureHandler)
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 2 {
+				panic("foo")
+			}
+			writer.Write(item)
+		}, sumReducer, WithName("import-users"), WithLogger(slog.New(handler)), WithPanicHandler(func(r any) error {
+			return errDummy
+		}))
+		assert.ErrorIs(t, err, errDummy)
+		if assert.Len(t, handler.records, 1) {
+			assert.Equal(t, slog.LevelError, handler.records[0].Level)
+			assert.Equal(t, map[string]any{
+				"panic": "foo",
+				"phase": "map",
+				"name":  "import-users",
+			}, handler.attrs(0))
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		handler := new(captureHandler)
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			cancel(errDummy)
+		}, WithLogger(slog.New(handler)))
+		assert.ErrorIs(t, err, errDummy)
+		if assert.Len(t, handler.records, 1) {
+			attrs := handler.attrs(0)
+			assert.Equal(t, "reduce", attrs["phase"])
+			assert.Equal(t, err, attrs["error"])
+		}
+	})
+}
+
+func TestWithName(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("cancel", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 2 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer, WithName("import-users"))
+		assert.ErrorIs(t, err, errDummy)
+		assert.EqualError(t, err, "mapreduce[import-users]: dummy")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			panic("foo")
+		}, sumReducer, WithName("import-users"), WithPanicHandler(func(r any) error {
+			return nil
+		}))
+		assert.EqualError(t, err, "mapreduce[import-users]: panic: foo")
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		var names sync.Map
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithName("import-users"), WithMetrics(func(stat Stat) {
+			names.Store(stat.Name, struct{}{})
+		}))
+		assert.Nil(t, err)
+		_, ok := names.Load("import-users")
+		assert.True(t, ok)
+	})
+}
+
+func TestMapReduceError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("mapper cancel", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 2 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+		assert.Equal(t, errDummy.Error(), err.Error())
+		var mre *MapReduceError
+		if assert.True(t, errors.As(err, &mre)) {
+			assert.Equal(t, PhaseMap, mre.Phase)
+			assert.Nil(t, mre.PanicValue)
+		}
+	})
+
+	t.Run("reducer cancel", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			cancel(nil)
+		})
+		assert.ErrorIs(t, err, ErrCancelWithNil)
+		var mre *MapReduceError
+		if assert.True(t, errors.As(err, &mre)) {
+			assert.Equal(t, PhaseReduce, mre.Phase)
+		}
+	})
+
+	t.Run("no output", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			drain(pipe)
+		})
+		assert.Equal(t, ErrReduceNoOutput, err)
+	})
+
+	t.Run("panic handler returns nil", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			panic("foo")
+		}, sumReducer, WithPanicHandler(func(r any) error {
+			return nil
+		}))
+		assert.EqualError(t, err, "panic: foo")
+	})
+}
+
+func TestErrorPredicates(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name     string
+		err      error
+		withNil  bool
+		noOutput bool
+	}{
+		{
+			name:    "cancelled with nil",
+			err:     ErrCancelWithNil,
+			withNil: true,
+		},
+		{
+			name:    "wrapped cancelled with nil",
+			err:     fmt.Errorf("wrapped: %w", newCancelError("", PhaseMap, nil)),
+			withNil: true,
+		},
+		{
+			name:     "no output",
+			err:      ErrReduceNoOutput,
+			noOutput: true,
+		},
+		{
+			name:     "wrapped no output",
+			err:      fmt.Errorf("wrapped: %w", ErrReduceNoOutput),
+			noOutput: true,
+		},
+		{
+			name: "other",
+			err:  errDummy,
+		},
+		{
+			name: "nil",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.withNil, IsCancelledWithNil(test.err))
+			assert.Equal(t, test.noOutput, IsNoReduceOutput(test.err))
+		})
+	}
+
+	t.Run("returned", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1}), func(item int, writer Writer[int], cancel func(error)) {
+			cancel(nil)
+		}, sumReducer)
+		assert.True(t, IsCancelledWithNil(err))
+
+		_, err = MapReduce(FromSlice([]int{1}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			drain(pipe)
+		})
+		assert.True(t, IsNoReduceOutput(err))
+	})
+}
+
+func TestMapperPanicWithPanicHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	handler := func(recovered any) error {
+		return fmt.Errorf("recovered: %v", recovered)
+	}
+
+	t.Run("MapReduce", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 3 {
+				panic("foo")
+			}
+			writer.Write(item)
+		}, sumReducer, WithPanicHandler(handler))
+		assert.EqualError(t, err, "recovered: foo")
+	})
+
+	t.Run("ForEach", func(t *testing.T) {
+		var recovered atomic.Value
+		assert.NotPanics(t, func() {
+			ForEach(FromSlice([]int{1, 2, 3, 4}), func(item int) {
+				if item == 3 {
+					panic("foo")
+				}
+			}, WithPanicHandler(func(r any) error {
+				recovered.Store(r)
+				return handler(r)
+			}))
+		})
+		assert.Equal(t, "foo", recovered.Load())
+	})
+}
+
+func TestMapReduceVoidCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var result []int
+	err := MapReduceVoid(func(source chan<- int) {
+		source <- 0
+		source <- 1
+	}, func(i int, writer Writer[int], cancel func(error)) {
+		if i == 1 {
+			cancel(errors.New("anything"))
+		}
+		writer.Write(i)
+	}, func(pipe <-chan int, cancel func(error)) {
+		for item := range pipe {
+			i := item
+			result = append(result, i)
+		}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "anything", err.Error())
+}
+
+func TestMapReduceVoidCancelWithRemains(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var done int32
+	var result []int
+	err := MapReduceVoid(func(source chan<- int) {
+		defer atomic.AddInt32(&done, 1)
+		quit := QuitChan(source)
+		for i := 0; i < defaultWorkers*2; i++ {
+			select {
+			case <-quit:
+				return
+			case source <- i:
+			}
+		}
+	}, func(i int, writer Writer[int], cancel func(error)) {
+		if i == defaultWorkers/2 {
+			cancel(errors.New("anything"))
+		}
+		writer.Write(i)
+	}, func(pipe <-chan int, cancel func(error)) {
+		for item := range pipe {
+			result = append(result, item)
+		}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "anything", err.Error())
+	// the generate func watching QuitChan stops after cancelled, the remains are not sent
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&done) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestMapReduceWithoutReducerWrite(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	uids := []int{1, 2, 3}
+	res, err := MapReduce(func(source chan<- int) {
+		for _, uid := range uids {
+			source <- uid
+		}
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+		drain(pipe)
+		// not calling writer.Write(...), should not panic
+	})
+	assert.Equal(t, ErrReduceNoOutput, err)
+	assert.Equal(t, 0, res)
+}
+
+func TestMapReduceVoidPanicInReducer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const message = "foo"
+	assert.Panics(t, func() {
+		var done int32
+		_ = MapReduceVoid(func(source chan<- int) {
+			for i := 0; i < defaultWorkers*2; i++ {
+				source <- i
+			}
+			atomic.AddInt32(&done, 1)
+		}, func(i int, writer Writer[int], cancel func(error)) {
+			writer.Write(i)
+		}, func(pipe <-chan int, cancel func(error)) {
+			panic(message)
+		}, WithWorkers(1))
+	})
+}
+
+func TestMapReduceVoidPanicInMapper(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const message = "foo"
+	mapper := func(i int, writer Writer[int], cancel func(error)) {
+		if i == 2 {
+			panic(message)
+		}
+		writer.Write(i)
+	}
+
+	t.Run("panic in caller", func(t *testing.T) {
+		// the mapper panic is recovered and re-panicked in the caller goroutine, never crashes the process
+		assert.PanicsWithValue(t, message, func() {
+			_ = MapReduceVoid(FromSlice([]int{1, 2, 3}), mapper, func(pipe <-chan int, cancel func(error)) {
+				drain(pipe)
+			})
+		})
+	})
+
+	t.Run("panic handler", func(t *testing.T) {
+		err := MapReduceVoid(FromSlice([]int{1, 2, 3}), mapper, func(pipe <-chan int, cancel func(error)) {
+			drain(pipe)
+		}, WithPanicHandler(func(recovered any) error {
+			return nil
+		}))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), message)
+		var mre *MapReduceError
+		if assert.True(t, errors.As(err, &mre)) {
+			assert.Equal(t, PhaseMap, mre.Phase)
+		}
+	})
+}
+
+func TestForEachWithContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var done int32
+	ctx, cancel := context.WithCancel(context.Background())
+	ForEach(func(source chan<- int) {
+		for i := 0; i < defaultWorkers*2; i++ {
+			source <- i
+		}
+		atomic.AddInt32(&done, 1)
+	}, func(i int) {
+		if i == defaultWorkers/2 {
+			cancel()
+		}
+	}, WithContext(ctx))
+}
+
+func TestMapReduceWithContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var done int32
+	var result []int
+	ctx, cancel := context.WithCancel(context.Background())
+	err := MapReduceVoid(func(source chan<- int) {
+		defer atomic.AddInt32(&done, 1)
+		quit := QuitChan(source)
+		for i := 0; i < defaultWorkers*2; i++ {
+			select {
+			case <-quit:
+				return
+			case source <- i:
+			}
+		}
+	}, func(i int, writer Writer[int], c func(error)) {
+		if i == defaultWorkers/2 {
+			cancel()
+		}
+		writer.Write(i)
+	}, func(pipe <-chan int, cancel func(error)) {
+		for item := range pipe {
+			i := item
+			result = append(result, i)
+		}
+	}, WithContext(ctx))
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestMapReduceWithContextCause(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errCaller := errors.New("caller gone")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	_, err := MapReduce(intRange(defaultWorkers*2), func(item int, writer Writer[int], c func(error)) {
+		if item == defaultWorkers/2 {
+			cancel(errCaller)
+		}
+		writer.Write(item)
+	}, sumReducer, WithContext(ctx))
+	assert.ErrorIs(t, err, errCaller)
+}
+
+func TestMapReduceWithTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			time.Sleep(time.Millisecond * 100)
+			writer.Write(item)
+		}, sumReducer, WithTimeout(time.Millisecond*10))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, time.Since(start) < time.Millisecond*100)
+	})
+
+	t.Run("finished", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithTimeout(time.Second))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+}
+
+func TestMapReduceCtx(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, 10)
+	val, err := MapReduceCtx(FromSlice([]int{1, 2, 3}), func(ctx context.Context, item int, writer Writer[int],
+		cancel func(error)) {
+		writer.Write(item * ctx.Value(ctxKey{}).(int))
+	}, func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+		var result int
+		for item := range pipe {
+			result += item
+		}
+		writer.Write(result + ctx.Value(ctxKey{}).(int))
+	}, WithContext(ctx))
+	assert.Nil(t, err)
+	assert.Equal(t, 70, val)
+}
+
+func TestMapReduceCtxReducerValue(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	type traceKey struct{}
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-id")
+	// the ctx derived for timeout still carries the values of the customized ctx
+	val, err := MapReduceCtx(FromSlice([]int{1, 2, 3}), func(ctx context.Context, item int, writer Writer[int],
+		cancel func(error)) {
+		writer.Write(item)
+	}, func(ctx context.Context, pipe <-chan int, writer Writer[string], cancel func(error)) {
+		drain(pipe)
+		writer.Write(ctx.Value(traceKey{}).(string))
+	}, WithContext(ctx), WithTimeout(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, "trace-id", val)
+}
+
+func TestMapReduceCtxMapperCancelled(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var cause atomic.Value
+	_, err := MapReduceCtx(FromSlice([]int{0, 1}), func(ctx context.Context, item int, writer Writer[int],
+		cancel func(error)) {
+		if item == 0 {
+			time.Sleep(time.Millisecond * 10)
+			cancel(errDummy)
+			return
+		}
+
+		// the long-running mapper polls ctx to stop early
+		for i := 0; i < 1000; i++ {
+			if ctx.Err() != nil {
+				cause.Store(context.Cause(ctx))
+				return
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		writer.Write(item)
+	}, func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+		drain(pipe)
+		writer.Write(0)
+	}, WithWorkers(2))
+	assert.ErrorIs(t, err, errDummy)
+	assert.Eventually(t, func() bool {
+		return cause.Load() != nil
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, cause.Load().(error), errDummy)
+}
+
+func TestWithMapperTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mapper := func(ctx context.Context, item int, writer Writer[int], cancel func(error)) {
+		if item == 2 {
+			// hung until timed out
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * 5):
+			}
+		}
+		writer.Write(item)
+	}
+	reducer := func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+		var sum int
+		for item := range pipe {
+			sum += item
+		}
+		writer.Write(sum)
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		start := time.Now()
+		_, err := MapReduceCtx(FromSlice([]int{1, 2, 3}), mapper, reducer,
+			WithMapperTimeout(time.Millisecond*20))
+		assert.ErrorIs(t, err, ErrMapperTimeout)
+		var mre *MapReduceError
+		if assert.True(t, errors.As(err, &mre)) {
+			assert.Equal(t, PhaseMap, mre.Phase)
+		}
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		val, err := MapReduceCtx(FromSlice([]int{1, 2, 3}), mapper, reducer,
+			WithMapperTimeout(time.Millisecond*20), WithErrorFilter(func(err error) bool {
+				return !errors.Is(err, ErrMapperTimeout)
+			}))
+		assert.Nil(t, err)
+		assert.Equal(t, 4, val)
+	})
+
+	t.Run("in time", func(t *testing.T) {
+		val, err := MapReduceCtx(FromSlice([]int{1, 3}), mapper, reducer, WithMapperTimeout(time.Second))
+		assert.Nil(t, err)
+		assert.Equal(t, 4, val)
+	})
+}
+
+func TestWithMapperSemaphore(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const limit = 4
+	var running, maxRunning int32
+	val, err := MapReduce(func(source chan<- int) {
+		for i := 0; i < 100; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		writer.Write(1)
+	}, sumReducer, WithWorkers(16), WithMapperSemaphore(limit))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, val)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(limit))
+}
+
+func TestWithMapperSemaphoreCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var called int32
+	_, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6, 7, 8}), func(item int, writer Writer[int],
+		cancel func(error)) {
+		if atomic.AddInt32(&called, 1) == 1 {
+			// let the other mappers wait for the semaphore
+			time.Sleep(time.Millisecond * 20)
+			cancel(errDummy)
+			return
+		}
+		writer.Write(item)
+	}, sumReducer, WithWorkers(8), WithMapperSemaphore(1))
+	assert.ErrorIs(t, err, errDummy)
+	// the waiting mappers are skipped after cancelled
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+}
+
+func TestWithScaler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctrl := make(chan int)
+	gate := make(chan struct{})
+	var running int32
+	var val int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, err = MapReduce(func(source chan<- int) {
+			for i := 0; i < 100; i++ {
+				source <- i
+			}
+		}, func(item int, writer Writer[int], cancel func(error)) {
+			atomic.AddInt32(&running, 1)
+			<-gate
+			atomic.AddInt32(&running, -1)
+			writer.Write(1)
+		}, sumReducer, WithWorkers(2), WithScaler(ctrl))
+	}()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == 2
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&running))
+
+	ctrl <- 8
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == 8
+	}, time.Second, time.Millisecond)
+	close(gate)
+	<-done
+	assert.Nil(t, err)
+	assert.Equal(t, 100, val)
+}
+
+func TestWithWeightFunc(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const workers = 4
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+	weight := func(item int) int {
+		if item%10 == 0 {
+			// heavier than workers, clamped to workers
+			return workers * 2
+		}
+		return item%3 + 1
+	}
+
+	tests := []struct {
+		name string
+		run  func(mapper func(item int)) int
+	}{
+		{
+			name: "MapReduce",
+			run: func(mapper func(item int)) int {
+				val, err := MapReduce(FromSlice(items), func(item int, writer Writer[int],
+					cancel func(error)) {
+					mapper(item)
+					writer.Write(1)
+				}, sumReducer, WithWorkers(workers), WithWeightFunc(weight))
+				assert.Nil(t, err)
+				return val
+			},
+		},
+		{
+			name: "ForEachIndexed",
+			run: func(mapper func(item int)) int {
+				var count int32
+				ForEachIndexed(FromSlice(items), func(i, item int) {
+					mapper(item)
+					atomic.AddInt32(&count, 1)
+				}, WithWorkers(workers), WithWeightFunc(weight))
+				return int(count)
+			},
+		},
+		{
+			name: "OrderedMap",
+			run: func(mapper func(item int)) int {
+				return len(Collect(OrderedMap(FromSlice(items), func(item int, writer Writer[int]) {
+					mapper(item)
+					writer.Write(item)
+				}, WithWorkers(workers), WithWeightFunc(weight))))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var running, maxRunning int32
+			count := test.run(func(item int) {
+				w := int32(min(weight(item), workers))
+				n := atomic.AddInt32(&running, w)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -w)
+			})
+			assert.Equal(t, 100, count)
+			assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(workers))
+		})
+	}
+}
+
+func TestWithWorkerInitCleanup(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const workers = 4
+	// conn is the per-worker resource, which is used by one mapper at a time
+	type conn struct {
+		id     int32
+		busy   int32
+		closed bool
+	}
+
+	t.Run("all workers", func(t *testing.T) {
+		var inits int32
+		var lock sync.Mutex
+		var closed []*conn
+		var started sync.WaitGroup
+		started.Add(workers)
+		val, err := MapReduceCtx(intRange(100), func(ctx context.Context, item int, writer Writer[int],
+			cancel func(error)) {
+			c := WorkerValue(ctx).(*conn)
+			assert.Equal(t, int32(1), atomic.AddInt32(&c.busy, 1))
+			defer atomic.AddInt32(&c.busy, -1)
+			if item < workers {
+				// let all workers start before reusing them
+				started.Done()
+				started.Wait()
+			}
+			writer.Write(1)
+		}, func(ctx context.Context, pipe <-chan int, writer Writer[int], cancel func(error)) {
+			sumReducer(pipe, writer, cancel)
+		}, WithWorkers(workers), WithWorkerInit(func() any {
+			return &conn{id: atomic.AddInt32(&inits, 1)}
+		}), WithWorkerCleanup(func(value any) {
+			lock.Lock()
+			defer lock.Unlock()
+			c := value.(*conn)
+			assert.False(t, c.closed)
+			c.closed = true
+			closed = append(closed, c)
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, 100, val)
+		assert.Equal(t, int32(workers), atomic.LoadInt32(&inits))
+		assert.Len(t, closed, workers)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		var inits, cleanups int32
+		_, err := MapReduce(intRange(100), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 10 {
+				cancel(errDummy)
+			}
+			time.Sleep(time.Millisecond)
+			writer.Write(1)
+		}, sumReducer, WithWorkers(workers), WithWorkerInit(func() any {
+			atomic.AddInt32(&inits, 1)
+			return nil
+		}), WithWorkerCleanup(func(value any) {
+			atomic.AddInt32(&cleanups, 1)
+		}))
+		assert.ErrorIs(t, err, errDummy)
+		// the in-flight mappers are waited for to clean up the workers before returning
+		assert.Equal(t, atomic.LoadInt32(&inits), atomic.LoadInt32(&cleanups))
+		assert.LessOrEqual(t, atomic.LoadInt32(&inits), int32(workers))
+	})
+
+	t.Run("reducer panic", func(t *testing.T) {
+		var cleanups int32
+		assert.PanicsWithValue(t, "foo", func() {
+			_, _ = MapReduce(intRange(100), func(item int, writer Writer[int], cancel func(error)) {
+				writer.Write(item)
+			}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+				panic("foo")
+			}, WithWorkers(workers), WithWorkerCleanup(func(value any) {
+				assert.Nil(t, value)
+				atomic.AddInt32(&cleanups, 1)
+			}))
+		})
+		assert.LessOrEqual(t, atomic.LoadInt32(&cleanups), int32(workers))
+	})
+}
+
+func TestWithWarmup(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const workers = 8
+	gate := make(chan struct{})
+	var running int32
+	var val int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, err = MapReduce(func(source chan<- int) {
+			for i := 0; i < 100; i++ {
+				source <- i
+			}
+		}, func(item int, writer Writer[int], cancel func(error)) {
+			atomic.AddInt32(&running, 1)
+			<-gate
+			atomic.AddInt32(&running, -1)
+			writer.Write(1)
+		}, sumReducer, WithWorkers(workers), WithWarmup(time.Millisecond*300))
+	}()
+
+	// only 1 mapper is admitted in the first step of 100ms
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&running))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == workers
+	}, time.Second, time.Millisecond)
+	close(gate)
+	<-done
+	assert.Nil(t, err)
+	assert.Equal(t, 100, val)
+}
+
+func TestWithWarmupTooShort(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// the duration shorter than the steps means no warmup
+	for _, d := range []time.Duration{-time.Second, 0, time.Nanosecond, 3 * time.Nanosecond} {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, SumReducer[int], WithWarmup(d))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	}
+}
+
+func TestWithScheduleHook(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var scheduled, mapped int32
+	_, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+		cancel func(error)) {
+		atomic.AddInt32(&mapped, 1)
+		writer.Write(item)
+	}, sumReducer, WithContext(ctx), WithSequential(), WithScheduleHook(func() {
+		// cancel right after the first element is scheduled
+		if atomic.AddInt32(&scheduled, 1) == 2 {
+			cancel()
+		}
+	}))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&scheduled))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mapped))
+}
+
+func TestWithSentinel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// the endless generator sends the sentinel -1 after 1, 2, 3, and stops after quit is closed
+	generate := func(source chan<- int) {
+		quit := QuitChan(source)
+		for i := 1; ; i++ {
+			item := i
+			if i == 4 {
+				item = -1
+			}
+			select {
+			case <-quit:
+				return
+			case source <- item:
+			}
+		}
+	}
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}
+
+	t.Run("MapReduce", func(t *testing.T) {
+		val, err := MapReduce(generate, mapper, sumReducer, WithSentinel(-1, func(a, b int) bool {
+			return a == b
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("nil eq", func(t *testing.T) {
+		val, err := MapReduce(generate, mapper, sumReducer, WithSentinel(-1, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("BatchMapReduce", func(t *testing.T) {
+		val, err := BatchMapReduce(generate, func(items []int, writer Writer[int], cancel func(error)) {
+			for _, item := range items {
+				writer.Write(item)
+			}
+		}, sumReducer, WithBatch(2), WithSentinel(-1, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("OrderedMap", func(t *testing.T) {
+		assert.Equal(t, []int{1, 2, 3}, Collect(OrderedMap(generate, func(item int, writer Writer[int]) {
+			writer.Write(item)
+		}, WithSentinel(-1, nil))))
+	})
+
+	// neverClosed returns a channel with the sentinel -1 followed by more elements, which is never closed
+	neverClosed := func() chan int {
+		ch := make(chan int, 5)
+		for _, item := range []int{1, 2, 3, -1, 4} {
+			ch <- item
+		}
+		return ch
+	}
+
+	t.Run("FromChannel never closed", func(t *testing.T) {
+		val, err := MapReduce(FromChannel(neverClosed()), mapper, sumReducer, WithSentinel(-1, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("MapReduceChan never closed", func(t *testing.T) {
+		val, err := MapReduceChan(neverClosed(), mapper, sumReducer, WithSentinel(-1, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+
+	t.Run("MapWithSource never closed", func(t *testing.T) {
+		assert.ElementsMatch(t, []int{1, 2, 3}, Collect(MapWithSource(neverClosed(), func(item int,
+			writer Writer[int]) {
+			writer.Write(item)
+		}, WithSentinel(-1, nil))))
+	})
+}
+
+func TestWithMaxItems(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var mapped int32
+	val, err := MapReduce(intRange(1000), func(item int, writer Writer[int], cancel func(error)) {
+		atomic.AddInt32(&mapped, 1)
+		writer.Write(1)
+	}, sumReducer, WithMaxItems(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, val)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&mapped))
+}
+
+func TestMapReduceCancelWithEndlessGenerate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// stop stops the generate funcs not watching QuitChan, which are left blocked after cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	mapper := func(item int, writer Writer[int], cancel func(error)) {
+		if item == 10 {
+			cancel(errDummy)
+		}
+		writer.Write(item)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{
+			name: "not watching QuitChan",
+			run: func() error {
+				_, err := MapReduce(func(source chan<- int) {
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						case source <- i:
+						}
+					}
+				}, mapper, sumReducer)
+				return err
+			},
+			want: errDummy,
+		},
+		{
+			name: "watching QuitChan",
+			run: func() error {
+				_, err := MapReduce(func(source chan<- int) {
+					quit := QuitChan(source)
+					for i := 0; ; i++ {
+						select {
+						case <-quit:
+							return
+						case source <- i:
+						}
+					}
+				}, mapper, sumReducer)
+				return err
+			},
+			want: errDummy,
+		},
+		{
+			name: "batches",
+			run: func() error {
+				_, err := BatchMapReduce(RepeatForever(1), func(items []int, writer Writer[int], cancel func(error)) {
+					cancel(errDummy)
+				}, sumReducer, WithBatch(4))
+				return err
+			},
+			want: errDummy,
+		},
+		{
+			name: "indexed with max items",
+			run: func() error {
+				var mapped int32
+				ForEachIndexed(RepeatForever(1), func(index int, item int) {
+					atomic.AddInt32(&mapped, 1)
+				}, WithMaxItems(10))
+				if n := atomic.LoadInt32(&mapped); n != 10 {
+					return fmt.Errorf("mapped %d elements", n)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			returned := make(chan error)
+			go func() {
+				returned <- test.run()
+			}()
+
+			select {
+			case err := <-returned:
+				assert.ErrorIs(t, err, test.want)
+			case <-time.After(time.Second):
+				t.Fatal("blocked by the endless generate func")
+			}
+		})
+	}
+}
+
+func TestWithShutdownTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	run := func(cancelErr error, opts ...Option) (int, time.Duration, error) {
+		start := time.Now()
+		started := make(chan struct{})
+		val, err := MapReduce(FromSlice([]int{1, 2}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 1 {
+				<-started
+				if cancelErr != nil {
+					cancel(cancelErr)
+				}
+				writer.Write(item)
+				return
+			}
+
+			close(started)
+			// ignores cancellation
+			time.Sleep(time.Millisecond * 200)
+			writer.Write(item)
+		}, sumReducer, append(opts, WithWorkers(2), WithShutdownTimeout(time.Millisecond*20))...)
+		return val, time.Since(start), err
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		_, elapsed, err := run(ErrStop)
+		assert.ErrorIs(t, err, ErrShutdownTimeout)
+		assert.Less(t, elapsed, time.Millisecond*200)
+	})
+
+	t.Run("timeout after graceful cancel", func(t *testing.T) {
+		_, elapsed, err := run(errDummy, WithDrainPolicy(DrainPolicyGraceful))
+		assert.ErrorIs(t, err, ErrShutdownTimeout)
+		assert.ErrorIs(t, err, errDummy)
+		assert.Less(t, elapsed, time.Millisecond*200)
+	})
+
+	t.Run("slow without cancel", func(t *testing.T) {
+		val, _, err := run(nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, val)
+	})
+
+	t.Run("in time", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithShutdownTimeout(time.Millisecond*20))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+	})
+}
+
+func TestMapReduceWithStats(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("all", func(t *testing.T) {
+		val, stats, err := MapReduceWithStats(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			// odd items are written twice
+			for i := 0; i < item%2+1; i++ {
+				writer.Write(item)
+			}
+		}, sumReducer)
+		assert.Nil(t, err)
+		assert.Equal(t, 1+1+2+3+3+4+5+5, val)
+		assert.Equal(t, 5, stats.ItemsIn)
+		assert.Equal(t, 8, stats.MapOut)
+		assert.True(t, stats.Duration > 0)
+		assert.False(t, stats.Cancelled)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, stats, err := MapReduceWithStats(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 3 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer, WithSequential())
+		assert.ErrorIs(t, err, errDummy)
+		assert.Equal(t, 3, stats.ItemsIn)
+		assert.Equal(t, 2, stats.MapOut)
+		assert.True(t, stats.Cancelled)
+	})
+}
+
+func TestMapReduceWithMetrics(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const (
+		tasks   = 100
+		workers = 4
+	)
+	var maxInFlight, maxCompleted int64
+	val, err := MapReduce(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		time.Sleep(time.Millisecond)
+		writer.Write(item)
+	}, sumReducer, WithWorkers(workers), WithMetrics(func(stat Stat) {
+		for {
+			old := atomic.LoadInt64(&maxInFlight)
+			if int64(stat.InFlight) <= old || atomic.CompareAndSwapInt64(&maxInFlight, old, int64(stat.InFlight)) {
+				break
+			}
+		}
+		for {
+			old := atomic.LoadInt64(&maxCompleted)
+			if int64(stat.Completed) <= old || atomic.CompareAndSwapInt64(&maxCompleted, old, int64(stat.Completed)) {
+				break
+			}
+		}
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, tasks*(tasks-1)/2, val)
+	assert.True(t, maxInFlight > 0)
+	assert.True(t, maxInFlight <= workers)
+	assert.Equal(t, int64(tasks), maxCompleted)
+}
+
+func TestWithLatencyRecorder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const (
+		tasks = 10
+		delay = time.Millisecond * 10
+	)
+	var lock sync.Mutex
+	var durations []time.Duration
+	val, err := MapReduce(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int], cancel func(error)) {
+		time.Sleep(delay)
+		writer.Write(item)
+	}, sumReducer, WithWorkers(tasks), WithLatencyRecorder(func(d time.Duration) {
+		lock.Lock()
+		durations = append(durations, d)
+		lock.Unlock()
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, tasks*(tasks-1)/2, val)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, durations, tasks)
+	for _, d := range durations {
+		assert.GreaterOrEqual(t, d, delay)
+		assert.Less(t, d, delay*10)
+	}
+}
+
+func TestMapReduceWithRateLimit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("limited", func(t *testing.T) {
+		const tasks = 10
+		start := time.Now()
+		val, err := MapReduce(func(source chan<- int) {
+			for i := 0; i < tasks; i++ {
+				source <- i
+			}
+		}, func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithRateLimit(100))
+		elapsed := time.Since(start)
+		assert.Nil(t, err)
+		assert.Equal(t, 45, val)
+		assert.True(t, elapsed >= time.Millisecond*80, elapsed)
+		assert.True(t, elapsed < time.Millisecond*500, elapsed)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		start := time.Now()
+		_, err := MapReduce(intRange(10), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, sumReducer, WithRateLimit(1), WithTimeout(time.Millisecond*50))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+}
+
+func TestMapReduceGen(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pages := [][]int{{1, 2}, {3, 4}, {5, 6}}
+	tests := []struct {
+		name     string
+		failPage int
+		expect   int
+		err      error
+	}{
+		{
+			name:     "no error",
+			failPage: -1,
+			expect:   21,
+		},
+		{
+			name:     "fail on page",
+			failPage: 2,
+			err:      errDummy,
+		},
+		{
+			name:     "fail on first page",
+			failPage: 0,
+			err:      errDummy,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			val, err := MapReduceGen(func(source chan<- int) error {
+				for i, page := range pages {
+					if i == test.failPage {
+						return errDummy
+					}
+					for _, item := range page {
+						source <- item
+					}
+				}
+				return nil
+			}, func(item int, writer Writer[int], cancel func(error)) {
+				writer.Write(item)
+			}, sumReducer)
+			assert.Equal(t, test.expect, val)
+			if test.err == nil {
+				assert.Nil(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, test.err)
+			var mre *MapReduceError
+			if assert.True(t, errors.As(err, &mre)) {
+				assert.Equal(t, PhaseGenerate, mre.Phase)
+			}
+		})
+	}
+}
+
+func TestMapReduceInto(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("multiple values", func(t *testing.T) {
+		out := make(chan int)
+		var values []int
+		consumed := make(chan struct{})
+		go func() {
+			defer close(consumed)
+			for v := range out {
+				values = append(values, v)
+			}
+		}()
+
+		err := MapReduceInto(out, FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			// emit the sum of every two elements
+			Windowed(pipe, 2, func(items []int) int {
+				return items[0] + items[1]
+			}, writer)
+		})
+		assert.Nil(t, err)
+		<-consumed
+		assert.Len(t, values, 3)
+		var sum int
+		for _, v := range values {
+			sum += v
+		}
+		assert.Equal(t, 21, sum)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		out := make(chan int)
+		consumed := make(chan struct{})
+		go func() {
+			defer close(consumed)
+			drain(out)
+		}()
+
+		err := MapReduceInto(out, FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 2 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for item := range pipe {
+				writer.Write(item)
+			}
+		})
+		assert.ErrorIs(t, err, errDummy)
+		// out is closed after cancelled
+		<-consumed
+	})
+
+	t.Run("nil func", func(t *testing.T) {
+		out := make(chan int)
+		assert.Equal(t, ErrNilFunc, MapReduceInto[int, int, int](out, nil, nil, nil))
+		_, ok := <-out
+		assert.False(t, ok)
+		assert.Equal(t, ErrNilFunc, MapReduceInto[int, int, int](nil, FromSlice([]int{1}), nil, nil))
+	})
+}
+
+func TestMapReduceErrWithRetry(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	newMapper := func() MapperErrFunc[int, int] {
+		var failures int32
+		return func(item int, writer Writer[int]) error {
+			// item 2 fails twice then succeeds
+			if item == 2 && atomic.AddInt32(&failures, 1) <= 2 {
+				return errDummy
+			}
+
+			writer.Write(item)
+			return nil
+		}
+	}
+
+	t.Run("succeed after retries", func(t *testing.T) {
+		var attempts []int
+		val, err := MapReduceErr(FromSlice([]int{1, 2, 3}), newMapper(), sumReducer,
+			WithRetry(3, func(attempt int) time.Duration {
+				attempts = append(attempts, attempt)
+				return time.Millisecond
+			}))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, val)
+		assert.Equal(t, []int{1, 2}, attempts)
+	})
+
+	t.Run("fail without enough retries", func(t *testing.T) {
+		_, err := MapReduceErr(FromSlice([]int{1, 2, 3}), newMapper(), sumReducer, WithRetry(2, nil))
+		assert.ErrorIs(t, err, errDummy)
+	})
+
+	t.Run("fail without retry", func(t *testing.T) {
+		_, err := MapReduceErr(FromSlice([]int{1, 2, 3}), newMapper(), sumReducer)
+		assert.ErrorIs(t, err, errDummy)
+	})
+
+	t.Run("cancelled between retries", func(t *testing.T) {
+		start := time.Now()
+		_, err := MapReduceErr(FromSlice([]int{1, 2, 3}), newMapper(), sumReducer,
+			WithRetry(3, func(attempt int) time.Duration {
+				return time.Hour
+			}), WithTimeout(time.Millisecond*10))
+		assert.NotNil(t, err)
+		assert.True(t, time.Since(start) < time.Second)
+	})
 }
 
 func BenchmarkMapReduce(b *testing.B) {
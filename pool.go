@@ -0,0 +1,64 @@
+package mapreduce
+
+import "sync"
+
+// Pool is a set of persistent worker goroutines, which can be shared by mapreduce processings
+// with WithPool to avoid starting a goroutine for each element.
+// Go doesn't allow type parameters on methods, so Pool is passed as an option.
+type Pool struct {
+	tasks  chan func()
+	lock   sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewPool returns a Pool with given number of worker goroutines.
+func NewPool(workers int) *Pool {
+	workers = clampWorkers(workers)
+	p := &Pool{
+		tasks: make(chan func()),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+
+	return p
+}
+
+// Close stops the worker goroutines after the submitted tasks are done.
+// The processings using a closed Pool start goroutines as if no Pool is used.
+func (p *Pool) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.tasks)
+	p.lock.Unlock()
+
+	p.wg.Wait()
+}
+
+// submit runs task on a worker goroutine, or on a new goroutine if p is nil or closed.
+func (p *Pool) submit(task func()) {
+	if p == nil {
+		go task()
+		return
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		go task()
+		return
+	}
+
+	p.tasks <- task
+}
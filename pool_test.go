@@ -0,0 +1,91 @@
+package mapreduce
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestPool(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pool := NewPool(8)
+	defer pool.Close()
+
+	square := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item * item)
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), square, sumReducer, WithPool(pool))
+			assert.Nil(t, err)
+			assert.Equal(t, 30, val)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), square, sumReducer, WithPool(pool), WithWorkers(2))
+				assert.Nil(t, err)
+				assert.Equal(t, 30, val)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+			if item == 2 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, sumReducer, WithPool(pool))
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestPoolClosed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pool := NewPool(2)
+	pool.Close()
+	pool.Close()
+
+	val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}, sumReducer, WithPool(pool))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, val)
+}
+
+func BenchmarkMapReduceWithPool(b *testing.B) {
+	b.ReportAllocs()
+
+	pool := NewPool(defaultWorkers)
+	defer pool.Close()
+	mapper := func(v int64, writer Writer[int64], cancel func(error)) {
+		writer.Write(v * v)
+	}
+	reducer := func(input <-chan int64, writer Writer[int64], cancel func(error)) {
+		var result int64
+		for v := range input {
+			result += v
+		}
+		writer.Write(result)
+	}
+
+	for i := 0; i < b.N; i++ {
+		MapReduce(func(input chan<- int64) {
+			for j := 0; j < 2; j++ {
+				input <- int64(j)
+			}
+		}, mapper, reducer, WithPool(pool))
+	}
+}
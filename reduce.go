@@ -0,0 +1,240 @@
+package mapreduce
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// Number is the constraint of the numeric types that can be summed.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Reduce folds all the elements from pipe into a single value, starting from initial.
+func Reduce[T, U any](pipe <-chan T, initial U, fn func(acc U, item T) U) U {
+	acc := initial
+	for item := range pipe {
+		acc = fn(acc, item)
+	}
+
+	return acc
+}
+
+// SumReducer is a ReducerFunc that writes the sum of all the elements from pipe, 0 if pipe is empty.
+func SumReducer[T Number](pipe <-chan T, writer Writer[T], cancel func(error)) {
+	var sum T
+	for item := range pipe {
+		sum += item
+	}
+	writer.Write(sum)
+}
+
+// MaxReducer is a ReducerFunc that writes the max element from pipe, the zero value if pipe is empty.
+func MaxReducer[T cmp.Ordered](pipe <-chan T, writer Writer[T], cancel func(error)) {
+	writer.Write(reduceBy(pipe, func(a, b T) bool {
+		return cmp.Less(a, b)
+	}))
+}
+
+// MinReducer is a ReducerFunc that writes the min element from pipe, the zero value if pipe is empty.
+func MinReducer[T cmp.Ordered](pipe <-chan T, writer Writer[T], cancel func(error)) {
+	writer.Write(reduceBy(pipe, func(a, b T) bool {
+		return cmp.Less(b, a)
+	}))
+}
+
+// CountReducer is a ReducerFunc that writes the number of the elements from pipe.
+func CountReducer[T any](pipe <-chan T, writer Writer[int], cancel func(error)) {
+	var count int
+	for range pipe {
+		count++
+	}
+	writer.Write(count)
+}
+
+// Aggregate maps all elements generated from given generate func,
+// and folds all the output elements with combine into a single value, starting from seed.
+// Use cancel func in combine to cancel the processing.
+func Aggregate[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U], seed V,
+	combine func(acc V, item U, cancel func(error)) V, opts ...Option) (V, error) {
+	if combine == nil {
+		return seed, ErrNilFunc
+	}
+
+	return MapReduce(generate, mapper, func(pipe <-chan U, writer Writer[V], cancel func(error)) {
+		acc := seed
+		for item := range pipe {
+			acc = combine(acc, item, cancel)
+		}
+		writer.Write(acc)
+	}, opts...)
+}
+
+// FanOutFanIn maps all items with mapFn concurrently, and reduces all the outputs with reduceFn at once.
+// The order of the outputs passed to reduceFn is not guaranteed. reduceFn is called with nil if items is empty.
+// It trades streaming for simplicity, which fits the bounded inputs.
+// A panic in mapFn is re-raised in the caller, and reduceFn is not called if the processing fails.
+func FanOutFanIn[T, U, V any](items []T, mapFn func(item T) U, reduceFn func(outputs []U) V,
+	opts ...Option) (V, error) {
+	if mapFn == nil || reduceFn == nil {
+		var zero V
+		return zero, ErrNilFunc
+	}
+	if len(items) == 0 {
+		return reduceFn(nil), nil
+	}
+
+	outputs, err := MapReduceSlice(FromSlice(items), func(item T, writer Writer[U], cancel func(error)) {
+		writer.Write(mapFn(item))
+	}, opts...)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+
+	return reduceFn(outputs), nil
+}
+
+// Distinct collects the unique elements from pipe, preserving the first-seen order.
+// It's meant to be called in a reducer, which is the only consumer of pipe.
+func Distinct[T comparable](pipe <-chan T) []T {
+	return DistinctBy(pipe, func(item T) T {
+		return item
+	})
+}
+
+// DistinctBy collects the elements from pipe with unique keys returned from keyFn,
+// the first-seen element of each key is kept, preserving the first-seen order.
+func DistinctBy[T any, K comparable](pipe <-chan T, keyFn func(item T) K) []T {
+	var items []T
+	seen := make(map[K]struct{})
+	for item := range pipe {
+		key := keyFn(item)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// GroupBy groups all the elements from pipe by the key returned from keyFn.
+func GroupBy[T any, K comparable](pipe <-chan T, keyFn func(item T) K) map[K][]T {
+	groups := make(map[K][]T)
+	for item := range pipe {
+		key := keyFn(item)
+		groups[key] = append(groups[key], item)
+	}
+
+	return groups
+}
+
+// ReduceToMap collects all the key/value pairs from pipe into a map,
+// the last written value wins if a key is written more than once.
+// It's meant to be called in a reducer, which is the only consumer of pipe, so no locking is needed.
+func ReduceToMap[K comparable, V any](pipe <-chan Pair[K, V]) map[K]V {
+	return ReduceToMapMerge(pipe, nil)
+}
+
+// ReduceToMapMerge collects all the key/value pairs from pipe into a map,
+// merge is called with the existing value and the new one if a key is written more than once.
+// A nil merge means the last written value wins.
+func ReduceToMapMerge[K comparable, V any](pipe <-chan Pair[K, V], merge func(old, new V) V) map[K]V {
+	m := make(map[K]V)
+	for pair := range pipe {
+		if old, ok := m[pair.Key]; ok && merge != nil {
+			m[pair.Key] = merge(old, pair.Value)
+		} else {
+			m[pair.Key] = pair.Value
+		}
+	}
+
+	return m
+}
+
+// WriteJSONLines encodes all the elements from pipe into w as JSON values, one per line.
+// It returns on the first encoding or writing error, pass it to cancel to stop the processing.
+// It's meant to be called in a reducer, which is the only consumer of pipe.
+func WriteJSONLines[T any](w io.Writer, pipe <-chan T) error {
+	encoder := json.NewEncoder(w)
+	for item := range pipe {
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LineWriter returns a VoidReducerFunc that writes each element from pipe into w as a line formatted by format,
+// the write error is passed to cancel. It streams the lines without buffering, and can be used with MapReduceVoid.
+func LineWriter[T any](w io.Writer, format func(item T) string) VoidReducerFunc[T] {
+	return func(pipe <-chan T, cancel func(error)) {
+		for item := range pipe {
+			if _, err := io.WriteString(w, format(item)+"\n"); err != nil {
+				cancel(err)
+				return
+			}
+		}
+	}
+}
+
+// Collect drains all the elements from ch into a slice, which is non-nil even if ch is empty.
+func Collect[T any](ch <-chan T) []T {
+	items := make([]T, 0)
+	for item := range ch {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// SortedCollect drains all the elements from ch into a slice sorted by less,
+// which is non-nil even if ch is empty.
+func SortedCollect[T any](ch <-chan T, less func(a, b T) bool) []T {
+	items := Collect(ch)
+	sort.Slice(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	return items
+}
+
+// Windowed aggregates every size elements from pipe with agg, and writes the results into writer,
+// the last window might be smaller. Non-positive size means all the elements are in one window.
+// No window is written if pipe is empty.
+func Windowed[T, U any](pipe <-chan T, size int, agg func(items []T) U, writer Writer[U]) {
+	var window []T
+	for item := range pipe {
+		window = append(window, item)
+		if size > 0 && len(window) == size {
+			writer.Write(agg(window))
+			window = nil
+		}
+	}
+	if len(window) > 0 {
+		writer.Write(agg(window))
+	}
+}
+
+// reduceBy keeps the first element from pipe, and replaces it with each later one if replace returns true,
+// the zero value is returned if pipe is empty.
+func reduceBy[T any](pipe <-chan T, replace func(kept, item T) bool) T {
+	var kept T
+	var ok bool
+	for item := range pipe {
+		if !ok || replace(kept, item) {
+			kept = item
+			ok = true
+		}
+	}
+
+	return kept
+}
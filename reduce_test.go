@@ -0,0 +1,526 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestReduce(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	val, err := MapReduce(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item * item)
+	}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+		writer.Write(Reduce(pipe, 0, func(acc, item int) int {
+			return acc + item
+		}))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 30, val)
+}
+
+func TestReduceEmpty(t *testing.T) {
+	pipe := make(chan int)
+	close(pipe)
+	assert.Equal(t, 10, Reduce(pipe, 10, func(acc, item int) int {
+		return acc + item
+	}))
+}
+
+func TestNumericReducers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	identity := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}
+	tests := []struct {
+		name    string
+		reducer ReducerFunc[int, int]
+		items   []int
+		expect  int
+	}{
+		{
+			name:    "sum",
+			reducer: SumReducer[int],
+			items:   []int{3, -1, 4, 1, 5},
+			expect:  12,
+		},
+		{
+			name:    "sum empty",
+			reducer: SumReducer[int],
+		},
+		{
+			name:    "max",
+			reducer: MaxReducer[int],
+			items:   []int{3, -1, 4, 1, 5},
+			expect:  5,
+		},
+		{
+			name:    "max negative",
+			reducer: MaxReducer[int],
+			items:   []int{-3, -1, -4},
+			expect:  -1,
+		},
+		{
+			name:    "max empty",
+			reducer: MaxReducer[int],
+		},
+		{
+			name:    "min",
+			reducer: MinReducer[int],
+			items:   []int{3, -1, 4, 1, 5},
+			expect:  -1,
+		},
+		{
+			name:    "min positive",
+			reducer: MinReducer[int],
+			items:   []int{3, 2, 4},
+			expect:  2,
+		},
+		{
+			name:    "min empty",
+			reducer: MinReducer[int],
+		},
+		{
+			name:    "count",
+			reducer: CountReducer[int],
+			items:   []int{3, -1, 4, 1, 5},
+			expect:  5,
+		},
+		{
+			name:    "count empty",
+			reducer: CountReducer[int],
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			val, err := MapReduce(FromSlice(test.items), identity, test.reducer)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expect, val)
+		})
+	}
+
+	t.Run("float and string", func(t *testing.T) {
+		sum, err := MapReduce(FromSlice([]float64{1.5, 2.5}), func(item float64, writer Writer[float64],
+			cancel func(error)) {
+			writer.Write(item)
+		}, SumReducer[float64])
+		assert.Nil(t, err)
+		assert.Equal(t, 4.0, sum)
+
+		last, err := MapReduce(FromSlice([]string{"b", "c", "a"}), func(item string, writer Writer[string],
+			cancel func(error)) {
+			writer.Write(item)
+		}, MaxReducer[string])
+		assert.Nil(t, err)
+		assert.Equal(t, "c", last)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	square := func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item * item)
+	}
+	sum := func(acc, item int, cancel func(error)) int {
+		return acc + item
+	}
+
+	t.Run("seed 0", func(t *testing.T) {
+		val, err := Aggregate(FromSlice([]int{1, 2, 3, 4}), square, 0, sum)
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+
+	t.Run("seed 100", func(t *testing.T) {
+		val, err := Aggregate(FromSlice([]int{1, 2, 3, 4}), square, 100, sum)
+		assert.Nil(t, err)
+		assert.Equal(t, 130, val)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		val, err := Aggregate(FromSlice([]int{}), square, 100, sum)
+		assert.Nil(t, err)
+		assert.Equal(t, 100, val)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		_, err := Aggregate(FromSlice([]int{1, 2, 3, 4}), square, 0, func(acc, item int, cancel func(error)) int {
+			if item == 9 {
+				cancel(errDummy)
+			}
+			return acc + item
+		})
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestFanOutFanIn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	square := func(item int) int {
+		return item * item
+	}
+	sum := func(outputs []int) int {
+		var result int
+		for _, v := range outputs {
+			result += v
+		}
+		return result
+	}
+
+	t.Run("sum of squares", func(t *testing.T) {
+		val, err := FanOutFanIn([]int{1, 2, 3, 4}, square, sum, WithWorkers(2))
+		assert.Nil(t, err)
+		assert.Equal(t, 30, val)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var called bool
+		val, err := FanOutFanIn(nil, square, func(outputs []int) int {
+			called = true
+			assert.Nil(t, outputs)
+			return sum(outputs)
+		})
+		assert.Nil(t, err)
+		assert.True(t, called)
+		assert.Equal(t, 0, val)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		var called bool
+		assert.PanicsWithValue(t, "foo", func() {
+			_, _ = FanOutFanIn([]int{1, 2, 3, 4, 5}, func(item int) int {
+				if item == 3 {
+					panic("foo")
+				}
+				return item
+			}, func(outputs []int) int {
+				called = true
+				return sum(outputs)
+			})
+		})
+		assert.False(t, called)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := FanOutFanIn([]int{1, 2, 3}, square, sum, WithContext(ctx))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("nil funcs", func(t *testing.T) {
+		_, err := FanOutFanIn[int, int, int]([]int{1}, nil, sum)
+		assert.Equal(t, ErrNilFunc, err)
+		_, err = FanOutFanIn[int, int, int]([]int{1}, square, nil)
+		assert.Equal(t, ErrNilFunc, err)
+	})
+}
+
+func TestDistinct(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("distinct", func(t *testing.T) {
+		pipe := make(chan int, 8)
+		for _, item := range []int{3, 1, 3, 2, 1, 3, 4, 2} {
+			pipe <- item
+		}
+		close(pipe)
+		assert.Equal(t, []int{3, 1, 2, 4}, Distinct(pipe))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		pipe := make(chan int)
+		close(pipe)
+		assert.Empty(t, Distinct(pipe))
+	})
+
+	t.Run("reducer", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			// the overlapping pages emit the same elements twice
+			writer.Write(item % 3)
+			writer.Write(item % 3)
+		}, func(pipe <-chan int, writer Writer[[]int], cancel func(error)) {
+			writer.Write(Distinct(pipe))
+		})
+		assert.Nil(t, err)
+		sort.Ints(val)
+		assert.Equal(t, []int{0, 1, 2}, val)
+	})
+}
+
+func TestDistinctBy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pipe := make(chan Pair[string, int], 5)
+	pipe <- Pair[string, int]{Key: "a", Value: 1}
+	pipe <- Pair[string, int]{Key: "b", Value: 2}
+	pipe <- Pair[string, int]{Key: "a", Value: 3}
+	pipe <- Pair[string, int]{Key: "c", Value: 4}
+	pipe <- Pair[string, int]{Key: "b", Value: 5}
+	close(pipe)
+	assert.Equal(t, []Pair[string, int]{
+		{Key: "a", Value: 1},
+		{Key: "b", Value: 2},
+		{Key: "c", Value: 4},
+	}, DistinctBy(pipe, func(item Pair[string, int]) string {
+		return item.Key
+	}))
+}
+
+func TestGroupBy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	val, err := MapReduce(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int], cancel func(error)) {
+		writer.Write(item)
+	}, func(pipe <-chan int, writer Writer[map[bool][]int], cancel func(error)) {
+		writer.Write(GroupBy(pipe, func(item int) bool {
+			return item%2 == 0
+		}))
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int{2, 4}, val[true])
+	assert.ElementsMatch(t, []int{1, 3, 5}, val[false])
+}
+
+func TestGroupByEmpty(t *testing.T) {
+	pipe := make(chan int)
+	close(pipe)
+	groups := GroupBy(pipe, func(item int) int {
+		return item
+	})
+	assert.NotNil(t, groups)
+	assert.Empty(t, groups)
+}
+
+func TestReduceToMap(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	pairs := func() chan Pair[string, int] {
+		pipe := make(chan Pair[string, int], 4)
+		pipe <- Pair[string, int]{Key: "a", Value: 1}
+		pipe <- Pair[string, int]{Key: "b", Value: 2}
+		pipe <- Pair[string, int]{Key: "a", Value: 3}
+		pipe <- Pair[string, int]{Key: "a", Value: 4}
+		close(pipe)
+		return pipe
+	}
+
+	t.Run("last write wins", func(t *testing.T) {
+		assert.Equal(t, map[string]int{"a": 4, "b": 2}, ReduceToMap(pairs()))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert.Equal(t, map[string]int{"a": 8, "b": 2}, ReduceToMapMerge(pairs(), func(old, new int) int {
+			return old + new
+		}))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		pipe := make(chan Pair[string, int])
+		close(pipe)
+		assert.Empty(t, ReduceToMap(pipe))
+	})
+
+	t.Run("reducer", func(t *testing.T) {
+		val, err := MapReduce(FromSlice([]string{"a", "bb", "ccc"}), func(item string,
+			writer Writer[Pair[string, int]], cancel func(error)) {
+			writer.Write(Pair[string, int]{Key: item, Value: len(item)})
+		}, func(pipe <-chan Pair[string, int], writer Writer[map[string]int], cancel func(error)) {
+			writer.Write(ReduceToMap(pipe))
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]int{"a": 1, "bb": 2, "ccc": 3}, val)
+	})
+}
+
+// failingWriter fails all the writes with errDummy.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errDummy
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	items := func() chan Pair[string, int] {
+		pipe := make(chan Pair[string, int], 2)
+		pipe <- Pair[string, int]{Key: "a", Value: 1}
+		pipe <- Pair[string, int]{Key: "b", Value: 2}
+		close(pipe)
+		return pipe
+	}
+
+	t.Run("write", func(t *testing.T) {
+		var output strings.Builder
+		assert.Nil(t, WriteJSONLines(&output, items()))
+		assert.Equal(t, `{"Key":"a","Value":1}
+{"Key":"b","Value":2}
+`, output.String())
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		assert.True(t, errors.Is(WriteJSONLines(failingWriter{}, items()), errDummy))
+	})
+
+	t.Run("encode error", func(t *testing.T) {
+		pipe := make(chan func(), 1)
+		pipe <- func() {}
+		close(pipe)
+		assert.Error(t, WriteJSONLines(&strings.Builder{}, pipe))
+	})
+}
+
+func TestLineWriter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	format := func(item int) string {
+		return fmt.Sprintf("item-%d", item)
+	}
+
+	t.Run("write", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := MapReduceVoid(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item * 10)
+		}, LineWriter(&buf, format), WithSequential())
+		assert.Nil(t, err)
+		assert.Equal(t, "item-10\nitem-20\nitem-30\n", buf.String())
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		err := MapReduceVoid(FromSlice([]int{1, 2, 3}), func(item int, writer Writer[int], cancel func(error)) {
+			writer.Write(item)
+		}, LineWriter(failingWriter{}, format))
+		assert.ErrorIs(t, err, errDummy)
+	})
+}
+
+func TestCollect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("non empty", func(t *testing.T) {
+		items := Collect(Filter(FromSlice([]int{1, 2, 3, 4}), func(item int) bool {
+			return item%2 == 0
+		}))
+		sort.Ints(items)
+		assert.Equal(t, []int{2, 4}, items)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		ch := make(chan int)
+		close(ch)
+		items := Collect(ch)
+		assert.NotNil(t, items)
+		assert.Empty(t, items)
+	})
+}
+
+func TestSortedCollect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	less := func(a, b int) bool {
+		return a < b
+	}
+
+	t.Run("shuffled", func(t *testing.T) {
+		items := SortedCollect(Map(FromSlice([]int{5, 3, 9, 1, 7, 2, 8, 4, 6, 0}), func(item int,
+			writer Writer[int]) {
+			writer.Write(item * 10)
+		}), less)
+		assert.Equal(t, []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90}, items)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		ch := make(chan int)
+		close(ch)
+		items := SortedCollect(ch, less)
+		assert.NotNil(t, items)
+		assert.Empty(t, items)
+	})
+}
+
+func TestWindowed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name   string
+		input  []int
+		size   int
+		expect []int
+	}{
+		{
+			name:   "with tail",
+			input:  []int{1, 2, 3, 4, 5, 6, 7},
+			size:   3,
+			expect: []int{6, 15, 7},
+		},
+		{
+			name:   "exact",
+			input:  []int{1, 2, 3, 4},
+			size:   2,
+			expect: []int{3, 7},
+		},
+		{
+			name:   "one window",
+			input:  []int{1, 2, 3, 4},
+			size:   0,
+			expect: []int{10},
+		},
+		{
+			name:  "empty",
+			input: []int{},
+			size:  3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipe := make(chan int, len(test.input))
+			for _, item := range test.input {
+				pipe <- item
+			}
+			close(pipe)
+
+			writer := new(sliceWriter[int])
+			Windowed[int, int](pipe, test.size, func(items []int) int {
+				var sum int
+				for _, item := range items {
+					sum += item
+				}
+				return sum
+			}, writer)
+			assert.Equal(t, test.expect, writer.items)
+		})
+	}
+}
+
+func TestWindowedStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output, errChan := MapReduceStream(FromSlice([]int{1, 2, 3, 4, 5}), func(item int, writer Writer[int],
+		cancel func(error)) {
+		writer.Write(item)
+	}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+		Windowed(pipe, 2, func(items []int) int {
+			return len(items)
+		}, writer)
+	})
+
+	sizes := Collect(output)
+	sort.Ints(sizes)
+	assert.Equal(t, []int{1, 2, 2}, sizes)
+	assert.Nil(t, <-errChan)
+}
@@ -0,0 +1,388 @@
+package mapreduce
+
+import (
+	"context"
+	"fmt"
+)
+
+// Filter writes the elements generated from given generate into the returned channel
+// if predicate returns true. The predicate is called concurrently.
+// The returned channel must be drained by the caller, or the ctx customized by WithContext
+// must be cancelled to stop early.
+func Filter[T any](generate GenerateFunc[T], predicate func(item T) bool, opts ...Option) chan T {
+	if generate == nil || predicate == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapChan(source, panicChan, func(item T, writer Writer[T]) {
+		if predicate(item) {
+			writer.Write(item)
+		}
+	}, options)
+}
+
+// FlatMap maps all elements generated from given generate,
+// and writes all the elements of the returned slices into the returned channel.
+// The returned channel must be drained by the caller, or the ctx customized by WithContext
+// must be cancelled to stop early.
+func FlatMap[T, U any](generate GenerateFunc[T], mapper func(item T) []U, opts ...Option) chan U {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapChan(source, panicChan, func(item T, writer Writer[U]) {
+		for _, v := range mapper(item) {
+			writer.Write(v)
+		}
+	}, options)
+}
+
+// Map maps all elements generated from given generate,
+// and writes the output elements into the returned channel.
+// The returned channel must be drained by the caller, or the ctx customized by WithContext
+// must be cancelled to stop early. A panicking mapper stops the processing and closes the returned channel,
+// the panic is passed to the callback customized by WithOnError.
+func Map[T, U any](generate GenerateFunc[T], mapper MapFunc[T, U], opts ...Option) chan U {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	return mapChan(source, panicChan, mapper, options)
+}
+
+// Result is the output of a mapped element, with the error if the mapping failed.
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+// MapResults maps all elements generated from given generate,
+// and writes the results with either the value or the error into the returned channel.
+// The failed elements don't stop the processing, they are treated as data.
+// The returned channel must be drained by the caller, or the ctx customized by WithContext
+// must be cancelled to stop early.
+func MapResults[T, U any](generate GenerateFunc[T], mapper func(item T) (U, error), opts ...Option) chan Result[U] {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	return Map(generate, func(item T, writer Writer[Result[U]]) {
+		v, err := mapper(item)
+		writer.Write(Result[U]{
+			Value: v,
+			Err:   err,
+		})
+	}, opts...)
+}
+
+// MapWithSource maps all elements from source, and writes the output elements into the returned channel.
+// The source is drained if the processing stops early, and it's read until the sentinel customized by WithSentinel
+// if any, even if it's never closed. The returned channel must be drained by the caller,
+// or the ctx customized by WithContext must be cancelled to stop early.
+func MapWithSource[T, U any](source <-chan T, mapper MapFunc[T, U], opts ...Option) chan U {
+	if source == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	return mapChan(withSentinel(source, options), panicChan, mapper, options)
+}
+
+// MapReduceStream maps all elements generated from given generate func,
+// and reduces the output elements with given reducer, which can write multiple values.
+// The written values are sent into the returned value channel, which must be drained by the caller.
+// The returned error channel receives the error if any, both channels are closed after processing.
+// The panics are received as errors from the error channel if no panic handler is customized.
+func MapReduceStream[T, U, V any](generate GenerateFunc[T], mapper MapperFunc[T, U], reducer ReducerFunc[U, V],
+	opts ...Option) (<-chan V, <-chan error) {
+	output := make(chan V)
+	errChan := make(chan error, 1)
+	if generate == nil || mapper == nil || reducer == nil {
+		close(output)
+		errChan <- ErrNilFunc
+		close(errChan)
+		return output, errChan
+	}
+
+	go func() {
+		// stop is closed to drop the writes after cancelled
+		stop := make(chan struct{})
+		// reduced is closed after reducer returned, then output can be closed safely
+		reduced := make(chan struct{})
+		defer func() {
+			close(stop)
+			<-reduced
+			close(output)
+			close(errChan)
+		}()
+		// the processing runs in this goroutine, panicking here can't be recovered by the caller
+		defer func() {
+			if r := recover(); r != nil {
+				errChan <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		_, err := MapReduceCtx(generate, withoutCtxMapper(mapper), func(ctx context.Context, pipe <-chan U,
+			writer Writer[struct{}], cancel func(error)) {
+			defer close(reduced)
+			reducer(pipe, newGuardedWriter(ctx, output, stop), cancel)
+			writer.Write(struct{}{})
+		}, opts...)
+		if err != nil {
+			errChan <- err
+		}
+	}()
+
+	return output, errChan
+}
+
+// Pipe maps all elements generated from given generate with stage1,
+// and maps the outputs of stage1 with stage2 concurrently,
+// the outputs of stage2 are written into the returned channel.
+// The opts are applied to both stages. The returned channel must be drained by the caller.
+func Pipe[T, U, V any](generate GenerateFunc[T], stage1 MapFunc[T, U], stage2 MapFunc[U, V], opts ...Option) chan V {
+	if generate == nil || stage1 == nil || stage2 == nil {
+		panic(ErrNilFunc)
+	}
+
+	// each stage has its own options, so that the first stage finishing doesn't cancel the second one.
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	intermediate := mapChan(source, panicChan, stage1, options)
+	return mapChan(intermediate, &onceChan{channel: make(chan panicValue)}, stage2, buildOptions(opts...))
+}
+
+// OrderedMap maps all elements generated from given generate,
+// and writes the output elements into the returned channel in the order of generation.
+// At most workers elements are being mapped or waiting to be written at the same time.
+// The returned channel must be drained by the caller.
+func OrderedMap[T, U any](generate GenerateFunc[T], mapper MapFunc[T, U], opts ...Option) chan U {
+	if generate == nil || mapper == nil {
+		panic(ErrNilFunc)
+	}
+
+	options := buildOptions(opts...)
+	panicChan := &onceChan{channel: make(chan panicValue)}
+	source := buildSource(generate, panicChan, options)
+	output := make(chan U, options.bufferSize)
+	// pool is released after the outputs of an element are written,
+	// so a slow mapper can't make the reorder buffer grow beyond workers.
+	pool := make(chan struct{}, options.workers)
+	// slots keeps the pending results in the order of generation
+	slots := make(chan chan []U, options.workers)
+	// items passes the elements with their slots to the mappers
+	items := make(chan orderedItem[T, U])
+	// done is closed when no more outputs will be written
+	done := make(chan struct{})
+
+	go func() {
+		defer func() {
+			close(slots)
+			close(items)
+			quitSource(source)
+			drain(source)
+		}()
+
+		// maxItems is counted here, because the drained elements in executeMappers would leave their slots empty
+		for scheduled := 0; options.maxItems <= 0 || scheduled < options.maxItems; scheduled++ {
+			select {
+			case <-options.ctx.Done():
+				return
+			case <-done:
+				return
+			case pool <- struct{}{}:
+				item, ok := <-source
+				if !ok {
+					<-pool
+					return
+				}
+
+				slot := make(chan []U, 1)
+				slots <- slot
+				select {
+				case <-options.ctx.Done():
+					return
+				case <-done:
+					return
+				case items <- orderedItem[T, U]{item: item, slot: slot}:
+				}
+			}
+		}
+	}()
+
+	skip := skipPanic(options)
+	go executeMappers(mapperContext[orderedItem[T, U], struct{}]{
+		ctx: options.ctx,
+		mapper: func(item orderedItem[T, U], _ Writer[struct{}]) {
+			writer := new(sliceWriter[U])
+			completed := false
+			defer func() {
+				// the slot of a skipped panicking mapper is filled without outputs, not to block the writing,
+				// otherwise the panic stops the writing.
+				if !completed && skip != nil {
+					item.slot <- nil
+				}
+			}()
+
+			mapper(item.item, writer)
+			completed = true
+			item.slot <- writer.items
+		},
+		source:     items,
+		panicChan:  panicChan,
+		collector:  make(chan struct{}),
+		doneChan:   done,
+		workers:    options.workers,
+		rateLimit:  options.rateLimit,
+		metrics:    options.metrics,
+		sequential: options.sequential,
+		pool:       options.pool,
+		skipPanic:  skip,
+		semaphore:  options.semaphore,
+		scaler:     options.scaler,
+		maxWorkers: options.maxWorkers,
+		weight: unwrapWeight(options.weight, func(item orderedItem[T, U]) any {
+			return item.item
+		}),
+		latency:    options.latency,
+		warmup:     options.warmup,
+		pressure:   options.pressure,
+		progress:   options.progress,
+		guard:      newCloseGuard(options),
+		onSchedule: options.scheduleHook,
+		workerInit: options.workerInit,
+		workerExit: options.workerExit,
+	})
+
+	go func() {
+		defer func() {
+			close(done)
+			close(output)
+			options.cancel()
+		}()
+
+		for {
+			select {
+			case <-options.ctx.Done():
+				return
+			case v := <-panicChan.channel:
+				handleStreamPanic(options, v)
+				return
+			case slot, ok := <-slots:
+				if !ok {
+					return
+				}
+
+				select {
+				case <-options.ctx.Done():
+					return
+				case v := <-panicChan.channel:
+					handleStreamPanic(options, v)
+					return
+				case items := <-slot:
+					for _, item := range items {
+						select {
+						case <-options.ctx.Done():
+							return
+						case output <- item:
+						}
+					}
+					<-pool
+				}
+			}
+		}
+	}()
+
+	return output
+}
+
+// orderedItem is an element to map with the slot keeping its outputs in OrderedMap.
+type orderedItem[T, U any] struct {
+	item T
+	slot chan []U
+}
+
+// mapChan maps all elements from source, and writes the output elements into the returned channel.
+func mapChan[T, U any](source <-chan T, panicChan *onceChan, mapper MapFunc[T, U],
+	options *mapReduceOptions) chan U {
+	collector := make(chan U, options.bufferSize)
+	output := make(chan U)
+
+	go executeMappers(mapperContext[T, U]{
+		ctx:        options.ctx,
+		mapper:     mapper,
+		source:     source,
+		panicChan:  panicChan,
+		collector:  collector,
+		workers:    options.workers,
+		rateLimit:  options.rateLimit,
+		metrics:    options.metrics,
+		sequential: options.sequential,
+		pool:       options.pool,
+		maxItems:   options.maxItems,
+		skipPanic:  skipPanic(options),
+		semaphore:  options.semaphore,
+		scaler:     options.scaler,
+		maxWorkers: options.maxWorkers,
+		weight:     options.weight,
+		latency:    options.latency,
+		warmup:     options.warmup,
+		pressure:   options.pressure,
+		progress:   options.progress,
+		guard:      newCloseGuard(options),
+		onSchedule: options.scheduleHook,
+		workerInit: options.workerInit,
+		workerExit: options.workerExit,
+	})
+
+	go func() {
+		defer func() {
+			close(output)
+			options.cancel()
+		}()
+
+		for {
+			select {
+			case v := <-panicChan.channel:
+				// mappers stop being scheduled after panicking, so collector will be closed.
+				handleStreamPanic(options, v)
+			case item, ok := <-collector:
+				if !ok {
+					return
+				}
+
+				select {
+				case <-options.ctx.Done():
+				case output <- item:
+				}
+			}
+		}
+	}()
+
+	return output
+}
+
+// sliceWriter keeps all the written elements of a single mapper call.
+type sliceWriter[T any] struct {
+	items []T
+}
+
+func (sw *sliceWriter[T]) Write(v T) {
+	sw.items = append(sw.items, v)
+}
+
+func (sw *sliceWriter[T]) WriteOK(v T) bool {
+	sw.Write(v)
+	return true
+}
@@ -0,0 +1,499 @@
+package mapreduce
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestFilter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output := Filter(func(source chan<- int) {
+		for i := 0; i <= 1000; i++ {
+			source <- i
+		}
+	}, func(item int) bool {
+		return item%2 == 0
+	})
+
+	var count int
+	for item := range output {
+		assert.Equal(t, 0, item%2)
+		count++
+	}
+	assert.Equal(t, 501, count)
+}
+
+func TestFlatMap(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output := FlatMap(FromSlice([]int{0, 1, 2, 3, 4}), func(item int) []int {
+		if item == 0 {
+			return nil
+		}
+		if item == 1 {
+			return []int{}
+		}
+
+		result := make([]int, item)
+		for i := range result {
+			result[i] = item
+		}
+		return result
+	})
+
+	var count, sum int
+	for item := range output {
+		count++
+		sum += item
+	}
+	assert.Equal(t, 2+3+4, count)
+	assert.Equal(t, 2*2+3*3+4*4, sum)
+}
+
+func TestMap(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output := Map(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int]) {
+		writer.Write(item * item)
+	})
+	items := Collect(output)
+	sort.Ints(items)
+	assert.Equal(t, []int{1, 4, 9, 16}, items)
+}
+
+func TestMapResults(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var values []int
+	var failed int
+	for result := range MapResults(FromSlice([]int{1, 2, 3, 4, 5, 6}), func(item int) (int, error) {
+		if item%3 == 0 {
+			return 0, errDummy
+		}
+		return item * item, nil
+	}) {
+		if result.Err != nil {
+			assert.ErrorIs(t, result.Err, errDummy)
+			failed++
+		} else {
+			values = append(values, result.Value)
+		}
+	}
+	sort.Ints(values)
+	assert.Equal(t, []int{1, 4, 16, 25}, values)
+	assert.Equal(t, 2, failed)
+}
+
+func TestMapAbandonedWithContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output := Map(func(source chan<- int) {
+		for i := 0; i < 10000; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int]) {
+		writer.Write(item)
+	}, WithContext(ctx))
+
+	for item := range output {
+		if item > 10 {
+			// found what needed, stop ranging without draining
+			break
+		}
+	}
+	// goleak verifies that all the goroutines exit after cancelled
+	cancel()
+}
+
+func TestMapWithSource(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("all", func(t *testing.T) {
+		source := make(chan int, 4)
+		for i := 1; i <= 4; i++ {
+			source <- i
+		}
+		close(source)
+
+		items := Collect(MapWithSource(source, func(item int, writer Writer[int]) {
+			writer.Write(item * item)
+		}))
+		sort.Ints(items)
+		assert.Equal(t, []int{1, 4, 9, 16}, items)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		source := make(chan int, 100)
+		for i := 0; i < 100; i++ {
+			source <- i
+		}
+		close(source)
+
+		var count int
+		for range MapWithSource(source, func(item int, writer Writer[int]) {
+			writer.Write(item)
+		}, WithContext(ctx), WithWorkers(1)) {
+			if count == 10 {
+				cancel()
+			}
+			count++
+		}
+		assert.True(t, count < 100)
+	})
+}
+
+func TestMapReduceStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("running sums", func(t *testing.T) {
+		output, errChan := MapReduceStream(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			var sum int
+			for item := range pipe {
+				sum += item
+				writer.Write(sum)
+			}
+		})
+
+		var result []int
+		for v := range output {
+			result = append(result, v)
+		}
+		assert.Len(t, result, 4)
+		assert.True(t, sort.IntsAreSorted(result))
+		assert.Equal(t, 10, result[len(result)-1])
+		assert.Nil(t, <-errChan)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		output, errChan := MapReduceStream(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			if item == 3 {
+				cancel(errDummy)
+			}
+			writer.Write(item)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for item := range pipe {
+				writer.Write(item)
+			}
+		})
+
+		for range output {
+		}
+		assert.ErrorIs(t, <-errChan, errDummy)
+	})
+}
+
+func TestPipe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output := Pipe(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int]) {
+		writer.Write(item * item)
+	}, func(item int, writer Writer[int]) {
+		writer.Write(-item)
+	}, WithWorkers(2))
+
+	var result []int
+	for item := range output {
+		result = append(result, item)
+	}
+	sort.Ints(result)
+	assert.Equal(t, []int{-16, -9, -4, -1}, result)
+}
+
+func TestPipeWithContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	output := Pipe(func(source chan<- int) {
+		for i := 0; i < 1000; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int]) {
+		writer.Write(item)
+	}, func(item int, writer Writer[int]) {
+		writer.Write(item)
+	}, WithContext(ctx))
+
+	var count int
+	for range output {
+		if count == 10 {
+			cancel()
+		}
+		count++
+	}
+	assert.True(t, count < 1000)
+}
+
+func TestOrderedMap(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const tasks = 100
+	output := OrderedMap(func(source chan<- int) {
+		for i := 0; i < tasks; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int]) {
+		// early items take longer to finish
+		if item < 10 {
+			time.Sleep(time.Millisecond * time.Duration(10-item))
+		}
+		writer.Write(item)
+	}, WithWorkers(4))
+
+	expect := 0
+	for item := range output {
+		assert.Equal(t, expect, item)
+		expect++
+	}
+	assert.Equal(t, tasks, expect)
+}
+
+func TestOrderedMapMultipleWrites(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	output := OrderedMap(FromSlice([]int{3, 0, 2, 1}), func(item int, writer Writer[int]) {
+		time.Sleep(time.Millisecond * time.Duration(item))
+		for i := 0; i < item; i++ {
+			writer.Write(item)
+		}
+	})
+
+	var result []int
+	for item := range output {
+		result = append(result, item)
+	}
+	assert.Equal(t, []int{3, 3, 3, 2, 2, 1}, result)
+}
+
+func TestOrderedMapWithOptions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	generate := func(source chan<- int) {
+		for i := 0; i < 100; i++ {
+			source <- i
+		}
+	}
+	identity := func(item int, writer Writer[int]) {
+		writer.Write(item)
+	}
+
+	t.Run("max items", func(t *testing.T) {
+		result := Collect(OrderedMap(generate, identity, WithMaxItems(10)))
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, result)
+	})
+
+	t.Run("semaphore", func(t *testing.T) {
+		var running, maxRunning int32
+		result := Collect(OrderedMap(generate, func(item int, writer Writer[int]) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			writer.Write(item)
+		}, WithMapperSemaphore(2)))
+		assert.Len(t, result, 100)
+		assert.True(t, sort.IntsAreSorted(result))
+		assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(2))
+	})
+
+	t.Run("skip panic", func(t *testing.T) {
+		result := Collect(OrderedMap(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int]) {
+			if item == 3 {
+				panic("foo")
+			}
+			writer.Write(item)
+		}, WithWorkerPanicPolicy(WorkerPanicSkip)))
+		assert.Equal(t, []int{1, 2, 4}, result)
+	})
+}
+
+func TestOrderedMapWithContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	output := OrderedMap(func(source chan<- int) {
+		for i := 0; i < 1000; i++ {
+			source <- i
+		}
+	}, func(item int, writer Writer[int]) {
+		writer.Write(item)
+	}, WithContext(ctx))
+
+	var count int
+	for item := range output {
+		if item == 10 {
+			cancel()
+		}
+		count++
+	}
+	assert.True(t, count < 1000)
+}
+
+func TestStreamPanicWithoutHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	mapper := func(item int, writer Writer[int]) {
+		if item == 3 {
+			panic("foo")
+		}
+		writer.Write(item)
+	}
+	onError := func(recovered *atomic.Value) Option {
+		return WithOnError(func(err error) {
+			recovered.Store(err)
+		})
+	}
+	assertPanicError := func(t *testing.T, recovered *atomic.Value) {
+		var mrErr *MapReduceError
+		err, _ := recovered.Load().(error)
+		if assert.ErrorAs(t, err, &mrErr) {
+			assert.Equal(t, PhaseMap, mrErr.Phase)
+			assert.Equal(t, "foo", mrErr.PanicValue)
+		}
+	}
+
+	t.Run("Map", func(t *testing.T) {
+		var recovered atomic.Value
+		for range Map(FromSlice([]int{1, 2, 3, 4}), mapper, onError(&recovered)) {
+		}
+		assertPanicError(t, &recovered)
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		var recovered atomic.Value
+		for range Filter(FromSlice([]int{1, 2, 3, 4}), func(item int) bool {
+			if item == 3 {
+				panic("foo")
+			}
+			return true
+		}, onError(&recovered)) {
+		}
+		assertPanicError(t, &recovered)
+	})
+
+	t.Run("Pipe", func(t *testing.T) {
+		var recovered atomic.Value
+		for range Pipe(FromSlice([]int{1, 2, 3, 4}), mapper, func(item int, writer Writer[int]) {
+			writer.Write(item)
+		}, onError(&recovered)) {
+		}
+		assertPanicError(t, &recovered)
+	})
+
+	t.Run("OrderedMap", func(t *testing.T) {
+		var recovered atomic.Value
+		for range OrderedMap(FromSlice([]int{1, 2, 3, 4}), mapper, onError(&recovered)) {
+		}
+		assertPanicError(t, &recovered)
+	})
+
+	t.Run("MapReduceStream", func(t *testing.T) {
+		output, errChan := MapReduceStream(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int],
+			cancel func(error)) {
+			mapper(item, writer)
+		}, func(pipe <-chan int, writer Writer[int], cancel func(error)) {
+			for item := range pipe {
+				writer.Write(item)
+			}
+		})
+		for range output {
+		}
+		err := <-errChan
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "foo")
+		}
+	})
+}
+
+func TestStreamNilFunc(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	generate := FromSlice([]int{1, 2, 3})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		Filter(generate, nil)
+	})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		FlatMap[int, int](generate, nil)
+	})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		Map[int, int](nil, func(item int, writer Writer[int]) {})
+	})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		MapWithSource[int, int](make(chan int), nil)
+	})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		OrderedMap[int, int](generate, nil)
+	})
+	assert.PanicsWithValue(t, ErrNilFunc, func() {
+		Pipe[int, int, int](generate, func(item int, writer Writer[int]) {}, nil)
+	})
+
+	output, errChan := MapReduceStream[int, int, int](generate, nil, nil)
+	for range output {
+	}
+	assert.Equal(t, ErrNilFunc, <-errChan)
+}
+
+func TestStreamWithPanicHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("Filter", func(t *testing.T) {
+		var recovered atomic.Value
+		output := Filter(FromSlice([]int{1, 2, 3, 4}), func(item int) bool {
+			if item == 3 {
+				panic("foo")
+			}
+			return true
+		}, WithPanicHandler(func(r any) error {
+			recovered.Store(r)
+			return nil
+		}))
+		for range output {
+		}
+		assert.Equal(t, "foo", recovered.Load())
+	})
+
+	t.Run("OrderedMap", func(t *testing.T) {
+		var recovered atomic.Value
+		output := OrderedMap(FromSlice([]int{1, 2, 3, 4}), func(item int, writer Writer[int]) {
+			if item == 3 {
+				panic("foo")
+			}
+			writer.Write(item)
+		}, WithPanicHandler(func(r any) error {
+			recovered.Store(r)
+			return nil
+		}))
+
+		var result []int
+		for item := range output {
+			result = append(result, item)
+		}
+		// the outputs before the panicking item might be written
+		assert.True(t, len(result) <= 2)
+		for i, item := range result {
+			assert.Equal(t, i+1, item)
+		}
+		assert.Equal(t, "foo", recovered.Load())
+	})
+}